@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/guardian/autopull/config"
+	"github.com/guardian/autopull/downloadmanager"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+keeps the bandwidth limiter in line with the max_bandwidth and bandwidth_schedule settings. The config file is read
+again when it changes (or on SIGHUP where there is one), so the limit can be changed while a download is running.
+A limit given on the commandline takes precedence over max_bandwidth in the config file.
+*/
+type BandwidthControl struct {
+	limiter       *downloadmanager.BandwidthLimiter
+	configPath    string
+	override      string
+	mutex         sync.Mutex
+	policy        *config.BandwidthPolicy
+	configModTime time.Time
+	reloadChan    chan os.Signal
+	stopChan      chan struct{}
+}
+
+func NewBandwidthControl(configPath string, override string, configuration *config.Configuration) (*BandwidthControl, error) {
+	b := &BandwidthControl{
+		configPath: configPath,
+		override:   override,
+		reloadChan: make(chan os.Signal, 1),
+		stopChan:   make(chan struct{}),
+	}
+	policy, policyErr := b.policyFor(configuration)
+	if policyErr != nil {
+		return nil, policyErr
+	}
+	b.policy = policy
+	if info, statErr := os.Stat(configPath); statErr == nil {
+		b.configModTime = info.ModTime()
+	}
+	b.limiter = downloadmanager.NewBandwidthLimiter(policy.RateAt(time.Now()))
+	return b, nil
+}
+
+func (b *BandwidthControl) policyFor(configuration *config.Configuration) (*config.BandwidthPolicy, error) {
+	defaultRate := configuration.MaxBandwidth
+	if b.override != "" {
+		defaultRate = b.override
+	}
+	return config.NewBandwidthPolicy(defaultRate, configuration.BandwidthSchedule)
+}
+
+func (b *BandwidthControl) Limiter() *downloadmanager.BandwidthLimiter {
+	return b.limiter
+}
+
+func (b *BandwidthControl) Start() {
+	notifyReload(b.reloadChan)
+	if rate := b.limiter.Rate(); rate > 0 {
+		log.Printf("INFO main bandwidth is limited to %s/s", FormatByteSize(rate, 0))
+	}
+	b.apply()
+	go b.run()
+}
+
+func (b *BandwidthControl) Stop() {
+	close(b.stopChan)
+}
+
+func (b *BandwidthControl) run() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopChan:
+			return
+		case sig := <-b.reloadChan:
+			log.Printf("INFO main received %s, reloading bandwidth settings from %s", sig, b.configPath)
+			b.reload()
+		case <-ticker.C:
+			if info, statErr := os.Stat(b.configPath); statErr == nil && !info.ModTime().Equal(b.configModTime) {
+				log.Printf("INFO main %s has changed, reloading bandwidth settings", b.configPath)
+				b.reload()
+			}
+		}
+		b.apply()
+	}
+}
+
+/**
+reads the bandwidth settings from the config file again. If they are not valid then the old ones are kept
+*/
+func (b *BandwidthControl) reload() {
+	if info, statErr := os.Stat(b.configPath); statErr == nil {
+		b.configModTime = info.ModTime()
+	}
+	configuration, configErr := config.LoadConfig(b.configPath)
+	if configErr != nil {
+		log.Printf("ERROR main could not reload config, keeping the current bandwidth settings: %s", configErr)
+		return
+	}
+	policy, policyErr := b.policyFor(configuration)
+	if policyErr != nil {
+		log.Printf("ERROR main invalid bandwidth settings, keeping the current ones: %s", policyErr)
+		return
+	}
+	b.mutex.Lock()
+	b.policy = policy
+	b.mutex.Unlock()
+}
+
+/**
+sets the limit for the current time of day, if it has changed
+*/
+func (b *BandwidthControl) apply() {
+	b.mutex.Lock()
+	rate := b.policy.RateAt(time.Now())
+	b.mutex.Unlock()
+
+	if rate == b.limiter.Rate() {
+		return
+	}
+	if rate == 0 {
+		log.Printf("INFO main bandwidth is now unlimited")
+	} else {
+		log.Printf("INFO main bandwidth is now limited to %s/s", FormatByteSize(rate, 0))
+	}
+	b.limiter.SetRate(rate)
+}
@@ -14,6 +14,8 @@ type ArchiveEntryDownloadSynopsis struct {
 	EntryId  string `json:"entryId"`
 	Path     string `json:"path"`
 	FileSize int64  `json:"fileSize"`
+	Checksum string `json:"checksum,omitempty"` //"md5:{value}", "sha256:{value}" or a bare value, if the server knows it
+	ETag     string `json:"etag,omitempty"`     //S3 ETag of the archived object, used when there is no checksum
 }
 
 type BulkDownloadInitiateResponse struct {
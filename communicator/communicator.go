@@ -1,6 +1,11 @@
 package communicator
 
-import "net/url"
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
 
 type CommunicatorType int
 
@@ -13,6 +18,8 @@ type Communicator struct {
 	VaultDoorUri     url.URL
 	ArchiveHunterUri url.URL
 	Type             CommunicatorType
+	Retry            RetryPolicy  //how to retry failed requests. DefaultRetryPolicy is used if this is not set
+	HttpClient       *http.Client //client for all requests. http.DefaultClient is used if this is not set
 }
 
 /**
@@ -28,3 +35,17 @@ func (comm *Communicator) GetActiveUrl() *url.URL {
 		return nil
 	}
 }
+
+/**
+waits for the given duration, returning early with an error if the context is cancelled
+*/
+func SleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
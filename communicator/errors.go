@@ -0,0 +1,83 @@
+package communicator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//what went wrong talking to the server. Use errors.Is to check the error returned from the Communicator against these.
+var (
+	ErrTokenInvalid      = errors.New("the download token is not valid or has expired")
+	ErrServerUnavailable = errors.New("the server is not available")
+	ErrMalformedResponse = errors.New("the server sent a response that could not be understood")
+	ErrNotRestored       = errors.New("the item has not been restored from the archive")
+	ErrRateLimited       = errors.New("the server is rate limiting requests")
+	ErrServerError       = errors.New("the server returned an error")
+)
+
+//how much of the response body to keep in a ResponseError
+const bodySnippetLength = 256
+
+/**
+an error response from the server. Kind is one of the Err... values above, so errors.Is(err, ErrTokenInvalid) etc. work.
+*/
+type ResponseError struct {
+	Kind       error
+	StatusCode int
+	Body       string //the start of the response body, for diagnosis
+	Cause      error  //the underlying problem, e.g. a json error for ErrMalformedResponse. May be nil
+}
+
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("%s (%d)", e.Kind, e.StatusCode)
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Kind
+}
+
+func bodySnippet(body []byte) string {
+	snippet := strings.TrimSpace(string(body))
+	if len(snippet) > bodySnippetLength {
+		snippet = snippet[:bodySnippetLength] + "..."
+	}
+	return snippet
+}
+
+func newResponseError(kind error, statusCode int, body []byte, cause error) *ResponseError {
+	return &ResponseError{Kind: kind, StatusCode: statusCode, Body: bodySnippet(body), Cause: cause}
+}
+
+/**
+reads the start of the body of a response that we are not going to use otherwise
+*/
+func readSnippet(resp *http.Response) []byte {
+	content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, bodySnippetLength+1))
+	return content
+}
+
+/**
+works out the kind of error from a status code, for responses that aren't a success
+*/
+func kindForStatus(statusCode int) error {
+	switch {
+	case statusCode == 429:
+		return ErrRateLimited
+	case IsRetryableStatus(statusCode):
+		//only the statuses that we wait and retry for, anything else won't go away by itself
+		return ErrServerUnavailable
+	default:
+		return ErrServerError
+	}
+}
@@ -0,0 +1,91 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"github.com/guardian/autopull/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedeemTokenErrors(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		body       string
+		kind       error
+	}{
+		{404, "no such token", ErrTokenInvalid},
+		{403, "token expired", ErrTokenInvalid},
+		{200, "<html>not json</html>", ErrMalformedResponse},
+		{429, "slow down", ErrRateLimited},
+		{503, "down for maintenance", ErrServerUnavailable},
+		{500, "oops", ErrServerError},
+		{400, "bad request", ErrServerError},
+	}
+	token := config.DownloadTokenUri{Proto: "archivehunter", Subtype: "bulkdownload", Token: "abc"}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.statusCode)
+			w.Write([]byte(test.body))
+		}))
+		serverUrl, _ := url.Parse(server.URL)
+		comm := Communicator{
+			ArchiveHunterUri: *serverUrl,
+			Type:             ArchiveHunter,
+			Retry:            RetryPolicy{MaxAttempts: 1, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		}
+		_, err := comm.RedeemToken(context.Background(), token)
+		server.Close()
+
+		if !errors.Is(err, test.kind) {
+			t.Errorf("%d: expected %s, got %v", test.statusCode, test.kind, err)
+			continue
+		}
+		var responseErr *ResponseError
+		if !errors.As(err, &responseErr) {
+			t.Errorf("%d: expected a ResponseError, got %T", test.statusCode, err)
+			continue
+		}
+		if responseErr.StatusCode != test.statusCode || responseErr.Body != test.body {
+			t.Errorf("%d: expected status %d and body '%s', got %d and '%s'", test.statusCode, test.statusCode, test.body, responseErr.StatusCode, responseErr.Body)
+		}
+	}
+}
+
+func TestResponseErrorBodySnippet(t *testing.T) {
+	err := newResponseError(ErrServerError, 400, []byte(strings.Repeat("x", 1000)), nil)
+	if len(err.Body) != bodySnippetLength+3 || !strings.HasSuffix(err.Body, "...") {
+		t.Errorf("body should have been cut down, got %d characters", len(err.Body))
+	}
+	if !strings.HasPrefix(err.Error(), ErrServerError.Error()+" (400): ") {
+		t.Errorf("unexpected message %s", err.Error())
+	}
+}
+
+func TestNotRestoredError(t *testing.T) {
+	body := `{"status":"ok","restoreStatus":"RS_PENDING","downloadLink":"http://example.com/file"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+	comm := Communicator{ArchiveHunterUri: *serverUrl, Type: ArchiveHunter}
+
+	linkInfo, linkErr := comm.GetItemLink(context.Background(), "LLT", "e1")
+	if linkErr != nil {
+		t.Fatalf("GetItemLink returned unexpected error %s", linkErr)
+	}
+	err := linkInfo.NotRestoredError()
+	if !errors.Is(err, ErrNotRestored) || !strings.Contains(err.Error(), "RS_PENDING") {
+		t.Errorf("unexpected error %v", err)
+	}
+	var responseErr *ResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != 200 || responseErr.Body != body {
+		t.Errorf("expected a ResponseError with the status and body of the response, got %#v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package communicator
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,13 +9,23 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"time"
 )
 
 type DownloadManagerItemResponse struct {
 	Status        string  `json:"status"`
 	RestoreStatus string  `json:"restoreStatus"`
 	DownloadLink  url.URL `json:"downloadLink"`
+	Checksum      string  `json:"checksum,omitempty"`
+	ETag          string  `json:"etag,omitempty"`
+	statusCode    int     //the http status and body that this came from, for reporting errors about the item
+	body          []byte
+}
+
+/**
+returns the ErrNotRestored error for an item that can't be downloaded because of its restore status
+*/
+func (r *DownloadManagerItemResponse) NotRestoredError() error {
+	return newResponseError(ErrNotRestored, r.statusCode, r.body, fmt.Errorf("restore status is %s", r.RestoreStatus))
 }
 
 func ParseDownloadManagerItemResponse(from []byte) (*DownloadManagerItemResponse, error) {
@@ -41,20 +52,41 @@ func ParseDownloadManagerItemResponse(from []byte) (*DownloadManagerItemResponse
 		return nil, urlParseErr
 	}
 
+	//checksum and etag are optional
+	checksum, _ := contentMap["checksum"].(string)
+	etag, _ := contentMap["etag"].(string)
+
 	return &DownloadManagerItemResponse{
 		Status:        status,
 		RestoreStatus: restoreStatus,
 		DownloadLink:  *downloadLinkPtr,
+		Checksum:      checksum,
+		ETag:          etag,
 	}, nil
 }
 
 /**
 gets the download link for the given item or an error
 */
-func (comm *Communicator) GetItemLink(longLivedToken string, fileId string, attempt int) (*DownloadManagerItemResponse, error) {
+func (comm *Communicator) GetItemLink(ctx context.Context, longLivedToken string, fileId string) (*DownloadManagerItemResponse, error) {
+	var rtn *DownloadManagerItemResponse
+	err := comm.RetryPolicy().Do(ctx, "communicator.GetItemLink", func() error {
+		var attemptErr error
+		rtn, attemptErr = comm.getItemLinkOnce(ctx, longLivedToken, fileId)
+		return attemptErr
+	})
+	return rtn, err
+}
+
+func (comm *Communicator) getItemLinkOnce(ctx context.Context, longLivedToken string, fileId string) (*DownloadManagerItemResponse, error) {
 	serverBase := comm.GetActiveUrl()
 	url := fmt.Sprintf("%s/api/bulk/%s/get/%s", serverBase.String(), longLivedToken, fileId)
-	resp, err := http.Get(url)
+	req, reqErr := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if reqErr != nil {
+		log.Printf("ERROR communicator.GetItemLink could not build request: %s", reqErr)
+		return nil, reqErr
+	}
+	resp, err := comm.Client().Do(req)
 	if err != nil {
 		log.Printf("ERROR communicator.GetItemLink could not establish connection: %s", err)
 		return nil, err
@@ -63,33 +95,30 @@ func (comm *Communicator) GetItemLink(longLivedToken string, fileId string, atte
 	bodyContent, readErr := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if readErr != nil {
-		log.Printf("ERROR communicator.GetItemLink could not read server response: %s", err)
-		return nil, err
+		log.Printf("ERROR communicator.GetItemLink could not read server response: %s", readErr)
+		return nil, readErr
 	}
 
+	if retryErr := retryableResponse(resp, bodyContent); retryErr != nil {
+		return nil, retryErr
+	}
 	switch resp.StatusCode {
 	case 200:
 		rtn, parseErr := ParseDownloadManagerItemResponse(bodyContent)
 		if parseErr != nil {
 			log.Printf("ERROR communicator.GetItemLink offending content was %s", string(bodyContent))
 			log.Printf("ERROR communicator.GetItemLink could not understand server response: %s", parseErr)
-			return nil, parseErr
+			return nil, newResponseError(ErrMalformedResponse, resp.StatusCode, bodyContent, parseErr)
 		}
+		rtn.statusCode = resp.StatusCode
+		rtn.body = bodyContent
 		return rtn, nil
-	case 502:
-		fallthrough
-	case 503:
-		fallthrough
-	case 504:
-		if attempt > 10 {
-			log.Printf("ERROR communicator.GetItemLink could not contact server after %d attempts, giving up", attempt)
-			return nil, errors.New("server not responding")
-		}
-		log.Printf("ERROR communcator.GetItemLink could not contact server on attemt %d. Retrying after a delay...", attempt)
-		time.Sleep(5 * time.Second)
-		return comm.GetItemLink(longLivedToken, fileId, attempt+1)
+	case 403:
+		//the long-lived token has expired or been revoked
+		log.Printf("ERROR communicator.GetItemLink server refused the download token: %s", string(bodyContent))
+		return nil, newResponseError(ErrTokenInvalid, resp.StatusCode, bodyContent, nil)
 	default:
 		log.Printf("ERROR communicator.GetItemLink server returned an error %d: %s", resp.StatusCode, string(bodyContent))
-		return nil, errors.New("server returned an error")
+		return nil, newResponseError(kindForStatus(resp.StatusCode), resp.StatusCode, bodyContent, nil)
 	}
 }
@@ -0,0 +1,125 @@
+package communicator
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+/**
+timeouts and connection pooling for talking to the servers
+*/
+type HttpSettings struct {
+	ConnectTimeout        time.Duration //how long to wait for a connection to be made
+	TLSHandshakeTimeout   time.Duration //how long to wait for the TLS handshake once connected
+	ResponseHeaderTimeout time.Duration //how long to wait for the server to start responding once the request is sent
+	IdleReadTimeout       time.Duration //how long a connection can go without receiving any data before it's dropped
+	PoolSize              int           //how many idle connections to keep open to each server
+	UserAgent             string
+	TLSConfig             *tls.Config    //extra CAs, client certificate etc. The system defaults are used if this is nil
+	Proxy                 *ProxySelector //which proxy to use for each server. The proxy environment variables are used if this is nil
+}
+
+var DefaultHttpSettings = HttpSettings{
+	ConnectTimeout:        30 * time.Second,
+	TLSHandshakeTimeout:   30 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	IdleReadTimeout:       120 * time.Second,
+	PoolSize:              5,
+	UserAgent:             "autopull",
+}
+
+/**
+a connection that is closed if nothing is received on it for a while, so that a stalled server can't hang a download
+forever. The deadline is pushed back before every read.
+*/
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+/**
+sets the User-Agent on every request that doesn't already have one
+*/
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+	//RoundTrippers must not modify the request they are given
+	withAgent := req.Clone(req.Context())
+	withAgent.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(withAgent)
+}
+
+/**
+builds an http client with the given timeouts. There is no overall timeout, because downloads of large files can
+legitimately take hours; instead connections are dropped if they go quiet for IdleReadTimeout.
+*/
+func NewHttpClient(settings HttpSettings) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   settings.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dialContext := dialer.DialContext
+	if settings.IdleReadTimeout > 0 {
+		dialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: settings.IdleReadTimeout}, nil
+		}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if settings.Proxy != nil {
+		proxy = settings.Proxy.Proxy
+	}
+
+	poolSize := settings.PoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          poolSize * 4,
+		MaxIdleConnsPerHost:   poolSize,
+		IdleConnTimeout:       90 * time.Second,
+		TLSClientConfig:       settings.TLSConfig,
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if settings.UserAgent != "" {
+		roundTripper = &userAgentTransport{base: transport, userAgent: settings.UserAgent}
+	}
+	return &http.Client{Transport: roundTripper}
+}
+
+/**
+returns the http client to use for all requests, including downloads
+*/
+func (comm *Communicator) Client() *http.Client {
+	if comm.HttpClient == nil {
+		return http.DefaultClient
+	}
+	return comm.HttpClient
+}
@@ -0,0 +1,57 @@
+package communicator
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewHttpClientUserAgent(t *testing.T) {
+	var seen string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	settings := DefaultHttpSettings
+	settings.UserAgent = "autopull/1.2"
+	response, err := NewHttpClient(settings).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	response.Body.Close()
+	if seen != "autopull/1.2" {
+		t.Errorf("expected User-Agent autopull/1.2, got '%s'", seen)
+	}
+}
+
+func TestNewHttpClientIdleReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("12345"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	settings := DefaultHttpSettings
+	settings.IdleReadTimeout = 200 * time.Millisecond
+	response, err := NewHttpClient(settings).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer response.Body.Close()
+
+	started := time.Now()
+	_, readErr := ioutil.ReadAll(response.Body)
+	if readErr == nil {
+		t.Error("expected the stalled read to fail")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("stalled read took %s to time out", elapsed)
+	}
+}
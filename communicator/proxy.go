@@ -0,0 +1,227 @@
+package communicator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//set as a proxy to connect to that server directly, even if there is a default proxy
+const ProxyDirect = "direct"
+
+/**
+which proxy to use to reach each of the servers we talk to. Anything left empty falls back to Default, and if that is
+empty too the usual HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+*/
+type ProxySettings struct {
+	Default       string   //proxy for anything that doesn't have its own setting
+	VaultDoor     string   //proxy for requests to VaultDoor
+	ArchiveHunter string   //proxy for requests to ArchiveHunter
+	Downloads     string   //proxy for fetching the files themselves, i.e. the S3 download links
+	NoProxy       []string //hosts, domains (".example.com" or "example.com"), IP addresses or CIDR ranges to always reach directly
+	Username      string   //credentials for the proxies, if they aren't already in the proxy urls
+	Password      string
+}
+
+func (s ProxySettings) IsEmpty() bool {
+	return s.Default == "" && s.VaultDoor == "" && s.ArchiveHunter == "" && s.Downloads == "" && len(s.NoProxy) == 0 &&
+		s.Username == "" && s.Password == ""
+}
+
+/**
+returns true if any of the servers has a proxy url of its own, rather than "direct" or the environment variables
+*/
+func (s ProxySettings) hasProxyUrl() bool {
+	for _, value := range []string{s.Default, s.VaultDoor, s.ArchiveHunter, s.Downloads} {
+		if value != "" && strings.ToLower(value) != ProxyDirect {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+decides which proxy each request goes through. Build one with NewProxySelector.
+*/
+type ProxySelector struct {
+	vaultDoorHost     string
+	archiveHunterHost string
+	vaultDoor         proxyChoice
+	archiveHunter     proxyChoice
+	downloads         proxyChoice
+	noProxy           []string
+	noProxyNets       []*net.IPNet
+}
+
+/**
+the proxy for one of the servers
+*/
+type proxyChoice struct {
+	proxyUrl    *url.URL //nil means connect directly
+	environment bool     //nothing was set, so follow the proxy environment variables
+}
+
+/**
+parses a single proxy setting. Returns nil for "direct".
+*/
+func parseProxyUrl(value string, username string, password string) (*url.URL, error) {
+	if strings.ToLower(value) == ProxyDirect {
+		return nil, nil
+	}
+	proxyUrl, parseErr := url.Parse(value)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("'%s' is not a proxy url, it must start with http://, https:// or socks5://", value)
+	}
+	if proxyUrl.Hostname() == "" {
+		return nil, fmt.Errorf("proxy url '%s' has no host", value)
+	}
+	if proxyUrl.User == nil && username != "" {
+		proxyUrl.User = url.UserPassword(username, password)
+	}
+	return proxyUrl, nil
+}
+
+/**
+checks the proxy settings and builds a selector from them. vaultDoor and archiveHunter are the servers' urls, used to
+tell which requests go to which server. Returns nil with no error if nothing has been set, in which case the environment
+variables should be used as normal.
+*/
+func NewProxySelector(settings ProxySettings, vaultDoor *url.URL, archiveHunter *url.URL) (*ProxySelector, error) {
+	if settings.IsEmpty() {
+		return nil, nil
+	}
+	if settings.Password != "" && settings.Username == "" {
+		return nil, errors.New("a proxy password needs a proxy username too")
+	}
+	if settings.Username != "" && !settings.hasProxyUrl() {
+		//they would be dropped, credentials aren't added to proxies from the HTTP_PROXY etc. environment variables
+		return nil, errors.New("proxy credentials are set but there is no proxy url for them to be used with")
+	}
+
+	selector := &ProxySelector{}
+	if vaultDoor != nil {
+		selector.vaultDoorHost = strings.ToLower(vaultDoor.Host)
+	}
+	if archiveHunter != nil {
+		selector.archiveHunterHost = strings.ToLower(archiveHunter.Host)
+	}
+
+	defaultProxy := proxyChoice{environment: true}
+	if settings.Default != "" {
+		proxyUrl, parseErr := parseProxyUrl(settings.Default, settings.Username, settings.Password)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		defaultProxy = proxyChoice{proxyUrl: proxyUrl}
+	}
+	endpoints := []struct {
+		value  string
+		target *proxyChoice
+	}{
+		{settings.VaultDoor, &selector.vaultDoor},
+		{settings.ArchiveHunter, &selector.archiveHunter},
+		{settings.Downloads, &selector.downloads},
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.value == "" {
+			*endpoint.target = defaultProxy
+			continue
+		}
+		proxyUrl, parseErr := parseProxyUrl(endpoint.value, settings.Username, settings.Password)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		*endpoint.target = proxyChoice{proxyUrl: proxyUrl}
+	}
+
+	for _, entry := range settings.NoProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, ipNet, cidrErr := net.ParseCIDR(entry)
+			if cidrErr != nil {
+				return nil, fmt.Errorf("no_proxy entry '%s' is not a valid CIDR range: %s", entry, cidrErr)
+			}
+			selector.noProxyNets = append(selector.noProxyNets, ipNet)
+		} else {
+			selector.noProxy = append(selector.noProxy, strings.TrimPrefix(entry, "*"))
+		}
+	}
+	return selector, nil
+}
+
+/**
+returns true if the given host should be reached without a proxy
+*/
+func (s *ProxySelector) bypass(host string) bool {
+	host = strings.ToLower(host)
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range s.noProxyNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, entry := range s.noProxy {
+		if entry == "*" || host == entry || host == strings.TrimPrefix(entry, ".") {
+			return true
+		}
+		//"example.com" and ".example.com" both cover the subdomains of example.com
+		if strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+returns the proxy to use for the given request, or nil to connect directly. Matches the signature of http.Transport.Proxy
+*/
+func (s *ProxySelector) Proxy(req *http.Request) (*url.URL, error) {
+	if s.bypass(req.URL.Hostname()) {
+		return nil, nil
+	}
+	var choice proxyChoice
+	switch strings.ToLower(req.URL.Host) {
+	case s.vaultDoorHost:
+		choice = s.vaultDoor
+	case s.archiveHunterHost:
+		choice = s.archiveHunter
+	default:
+		choice = s.downloads
+	}
+	if choice.environment {
+		return http.ProxyFromEnvironment(req)
+	}
+	return choice.proxyUrl, nil
+}
+
+/**
+describes where the proxy goes, without any credentials, for logging
+*/
+func (c proxyChoice) String() string {
+	if c.environment {
+		return "environment settings"
+	} else if c.proxyUrl == nil {
+		return ProxyDirect
+	}
+	return fmt.Sprintf("%s://%s", c.proxyUrl.Scheme, c.proxyUrl.Host)
+}
+
+/**
+returns a description of the proxies that will be used for each server, for logging
+*/
+func (s *ProxySelector) String() string {
+	return fmt.Sprintf("VaultDoor via %s, ArchiveHunter via %s, downloads via %s",
+		s.vaultDoor, s.archiveHunter, s.downloads)
+}
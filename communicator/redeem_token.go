@@ -2,15 +2,14 @@ package communicator
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/guardian/autopull/config"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"time"
 )
 
 /**
@@ -28,7 +27,7 @@ func asyncStreamingRetrieveContent(resp io.Reader) (chan *ArchiveEntryDownloadSy
 				var entry ArchiveEntryDownloadSynopsis
 				unmarshalErr := json.Unmarshal(rawContent, &entry)
 				if unmarshalErr != nil {
-					errCh <- unmarshalErr
+					errCh <- newResponseError(ErrMalformedResponse, 200, rawContent, unmarshalErr)
 				} else {
 					log.Printf("DEBUG asyncStreamingRetrieveContent got %v", entry)
 					outputCh <- &entry
@@ -78,16 +77,39 @@ the V2 api separates the token get and retrieval stages.  The BulkDownloadInitia
 we must populate with a subsequent call to summaryStream.
 This function consumes the result of summaryStream and fills the 'entries' field for us.
 */
-func (comm *Communicator) FetchDownloadSynopsisStreaming(partialResponse *BulkDownloadInitiateResponse, httpClient *http.Client, attempt int) (*BulkDownloadInitiateResponse, error) {
+func (comm *Communicator) FetchDownloadSynopsisStreaming(ctx context.Context, partialResponse *BulkDownloadInitiateResponse, httpClient *http.Client) (*BulkDownloadInitiateResponse, error) {
 	log.Printf("DEBUG communicator.RedeemToken no download synopsis data, retrieving from stream...")
 
+	var rtn *BulkDownloadInitiateResponse
+	err := comm.RetryPolicy().Do(ctx, "communicator.FetchDownloadSynopsisStreaming", func() error {
+		var attemptErr error
+		rtn, attemptErr = comm.fetchDownloadSynopsisOnce(ctx, partialResponse, httpClient)
+		return attemptErr
+	})
+	return rtn, err
+}
+
+func (comm *Communicator) fetchDownloadSynopsisOnce(ctx context.Context, partialResponse *BulkDownloadInitiateResponse, httpClient *http.Client) (*BulkDownloadInitiateResponse, error) {
 	url := fmt.Sprintf("%s/api/bulkv2/%s/summarystream", comm.ArchiveHunterUri.String(), partialResponse.RetrievalToken)
-	resp, err := httpClient.Get(url)
+	req, reqErr := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if reqErr != nil {
+		log.Printf("ERROR communicator.FetchDownloadSynopsisStreaming could not build request: %s", reqErr)
+		return nil, reqErr
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		log.Printf("ERROR communicator.FetchDownloadSynopsisStreaming could not make connection to server: %s", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if retryErr := RetryableResponse(resp); retryErr != nil {
+		return nil, retryErr
+	}
+	if resp.StatusCode != 200 {
+		body := readSnippet(resp)
+		log.Printf("ERROR communicator.FetchDownloadSynopsisStreaming server returned %d: %s", resp.StatusCode, string(body))
+		return nil, newResponseError(redeemErrorKind(resp.StatusCode), resp.StatusCode, body, nil)
+	}
 
 	entriesPtr, retrieveErr := consumeDownloadStream(resp.Body)
 	if retrieveErr != nil {
@@ -103,8 +125,24 @@ func (comm *Communicator) FetchDownloadSynopsisStreaming(partialResponse *BulkDo
 /**
 redeems the short-lived token and returns a pointer to the decoded response, or returns an error
 */
-func (comm *Communicator) RedeemToken(token config.DownloadTokenUri, attempt int) (*BulkDownloadInitiateResponse, error) {
-	client := http.Client{}
+func (comm *Communicator) RedeemToken(ctx context.Context, token config.DownloadTokenUri) (*BulkDownloadInitiateResponse, error) {
+	client := comm.Client()
+	var info *BulkDownloadInitiateResponse
+	err := comm.RetryPolicy().Do(ctx, "communicator.RedeemToken", func() error {
+		var attemptErr error
+		info, attemptErr = comm.redeemTokenOnce(ctx, token, client)
+		return attemptErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.Entries == nil {
+		return comm.FetchDownloadSynopsisStreaming(ctx, info, client)
+	}
+	return info, nil
+}
+
+func (comm *Communicator) redeemTokenOnce(ctx context.Context, token config.DownloadTokenUri, client *http.Client) (*BulkDownloadInitiateResponse, error) {
 	var url string
 	if token.ValidateVaultDoor() {
 		url = fmt.Sprintf("%s/api/bulk/%s", comm.VaultDoorUri.String(), token.Token)
@@ -112,7 +150,12 @@ func (comm *Communicator) RedeemToken(token config.DownloadTokenUri, attempt int
 		url = fmt.Sprintf("%s/api/bulkv2/%s", comm.ArchiveHunterUri.String(), token.Token)
 	}
 
-	resp, err := client.Get(url)
+	req, reqErr := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if reqErr != nil {
+		log.Printf("ERROR communicator.RedeemToken could not build request: %s", reqErr)
+		return nil, reqErr
+	}
+	resp, err := client.Do(req)
 
 	if err != nil {
 		log.Printf("ERROR communicator.RedeemToken could not make connection to server: %s", err)
@@ -120,39 +163,36 @@ func (comm *Communicator) RedeemToken(token config.DownloadTokenUri, attempt int
 	}
 
 	bodyContent, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 	if readErr != nil {
 		log.Printf("ERROR communicator.RedeemToken could not read server response: %s", readErr)
-		return nil, err
+		return nil, readErr
 	}
 
-	resp.Body.Close()
+	if retryErr := retryableResponse(resp, bodyContent); retryErr != nil {
+		return nil, retryErr
+	}
 	switch resp.StatusCode {
 	case 200:
 		var info BulkDownloadInitiateResponse
 		unmarshalErr := json.Unmarshal(bodyContent, &info)
 		if unmarshalErr != nil {
 			log.Printf("ERROR communicator.RedeemToken could not understand server response: %s", unmarshalErr)
-			return nil, unmarshalErr
-		}
-		if info.Entries == nil {
-			return comm.FetchDownloadSynopsisStreaming(&info, &client, 0)
-		} else {
-			return &info, nil
-		}
-	case 502:
-		fallthrough
-	case 503:
-		fallthrough
-	case 504:
-		if attempt > 10 {
-			log.Printf("ERROR communicator.RedeemToken Server is not available after %d attempts, giving up.", attempt)
-			return nil, errors.New("server was not available")
+			return nil, newResponseError(ErrMalformedResponse, resp.StatusCode, bodyContent, unmarshalErr)
 		}
-		log.Printf("ERROR communicator.RedeemToken Server is not available on attempt %d. Retrying after a delay...", attempt)
-		time.Sleep(5 * time.Second)
-		return comm.RedeemToken(token, attempt)
+		return &info, nil
 	default:
 		log.Printf("ERROR communicator.RedeemToken Server returned %d: %s", resp.StatusCode, string(bodyContent))
-		return nil, errors.New("invalid server response")
+		return nil, newResponseError(redeemErrorKind(resp.StatusCode), resp.StatusCode, bodyContent, nil)
+	}
+}
+
+/**
+the server says 403 or 404 if it doesn't recognise the token, which usually means that it has expired
+*/
+func redeemErrorKind(statusCode int) error {
+	if statusCode == 403 || statusCode == 404 {
+		return ErrTokenInvalid
 	}
+	return kindForStatus(statusCode)
 }
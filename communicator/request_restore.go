@@ -0,0 +1,97 @@
+package communicator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type RetrievalTier string
+
+const (
+	TierStandard  RetrievalTier = "Standard"
+	TierBulk      RetrievalTier = "Bulk"
+	TierExpedited RetrievalTier = "Expedited"
+)
+
+/**
+converts a retrieval tier name from the config into a RetrievalTier. Names are not case-sensitive.
+*/
+func ParseRetrievalTier(name string) (RetrievalTier, error) {
+	switch strings.ToLower(name) {
+	case "standard":
+		return TierStandard, nil
+	case "bulk":
+		return TierBulk, nil
+	case "expedited":
+		return TierExpedited, nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid retrieval tier, expected standard, bulk or expedited", name)
+	}
+}
+
+type restoreRequest struct {
+	Tier RetrievalTier `json:"tier"`
+}
+
+/**
+asks ArchiveHunter to start a restore from Glacier for the given item, using the given retrieval tier.
+returns nil if the restore was started
+*/
+func (comm *Communicator) RequestRestore(ctx context.Context, longLivedToken string, fileId string, tier RetrievalTier) error {
+	if comm.Type != ArchiveHunter {
+		return errors.New("restores can only be requested from ArchiveHunter")
+	}
+	return comm.RetryPolicy().Do(ctx, "communicator.RequestRestore", func() error {
+		return comm.requestRestoreOnce(ctx, longLivedToken, fileId, tier)
+	})
+}
+
+func (comm *Communicator) requestRestoreOnce(ctx context.Context, longLivedToken string, fileId string, tier RetrievalTier) error {
+	url := fmt.Sprintf("%s/api/bulkv2/%s/restore/%s", comm.ArchiveHunterUri.String(), longLivedToken, fileId)
+	requestBody, _ := json.Marshal(restoreRequest{Tier: tier})
+
+	req, reqErr := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(requestBody))
+	if reqErr != nil {
+		log.Printf("ERROR communicator.RequestRestore could not build request: %s", reqErr)
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := comm.Client().Do(req)
+	if err != nil {
+		log.Printf("ERROR communicator.RequestRestore could not establish connection: %s", err)
+		return err
+	}
+
+	bodyContent, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if readErr != nil {
+		log.Printf("ERROR communicator.RequestRestore could not read server response: %s", readErr)
+		return readErr
+	}
+
+	if retryErr := retryableResponse(resp, bodyContent); retryErr != nil {
+		return retryErr
+	}
+	switch resp.StatusCode {
+	case 200:
+		fallthrough
+	case 201:
+		fallthrough
+	case 202:
+		return nil
+	case 403:
+		log.Printf("ERROR communicator.RequestRestore server refused the download token: %s", string(bodyContent))
+		return newResponseError(ErrTokenInvalid, resp.StatusCode, bodyContent, nil)
+	default:
+		log.Printf("ERROR communicator.RequestRestore server returned an error %d: %s", resp.StatusCode, string(bodyContent))
+		return newResponseError(kindForStatus(resp.StatusCode), resp.StatusCode, bodyContent, nil)
+	}
+}
@@ -0,0 +1,51 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRequestRestore(t *testing.T) {
+	var method, path, contentType, body string
+	statusCode := 202
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		method, path, contentType, body = r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(content)
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+	comm := Communicator{
+		ArchiveHunterUri: *serverUrl,
+		Type:             ArchiveHunter,
+		Retry:            RetryPolicy{MaxAttempts: 1, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+	if err := comm.RequestRestore(context.Background(), "LLT", "e1", TierBulk); err != nil {
+		t.Fatalf("restore request should have succeeded, got %s", err)
+	}
+	if method != "PUT" || path != "/api/bulkv2/LLT/restore/e1" || contentType != "application/json" || body != `{"tier":"Bulk"}` {
+		t.Errorf("unexpected request %s %s %s %s", method, path, contentType, body)
+	}
+
+	statusCode = 403
+	if err := comm.RequestRestore(context.Background(), "LLT", "e1", TierBulk); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("expected ErrTokenInvalid for a 403, got %v", err)
+	}
+
+	method = ""
+	comm.Type = VaultDoor
+	comm.VaultDoorUri = *serverUrl
+	if err := comm.RequestRestore(context.Background(), "LLT", "e1", TierBulk); err == nil {
+		t.Error("restores should not be requested for VaultDoor")
+	}
+	if method != "" {
+		t.Error("no request should have been made for VaultDoor")
+	}
+}
@@ -0,0 +1,212 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//longest that we will wait when a server asks us to with Retry-After
+const maxRetryAfter = 15 * time.Minute
+
+/**
+how many times to try talking to a server and how long to wait in between. The wait doubles after each failed attempt,
+up to MaxDelay, and is jittered so that all of the download threads don't retry at once.
+*/
+type RetryPolicy struct {
+	MaxAttempts  int           //total number of attempts, including the first one
+	InitialDelay time.Duration //how long to wait after the first failure
+	MaxDelay     time.Duration //the wait doubles each time up to this limit
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  10,
+	InitialDelay: 2 * time.Second,
+	MaxDelay:     2 * time.Minute,
+}
+
+var jitterSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterMutex sync.Mutex
+
+/**
+returns how long to wait after the given (1-based) failed attempt. If the server asked us to wait for a while with
+Retry-After then we wait at least that long.
+*/
+func (p RetryPolicy) Delay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i += 1 {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	//wait somewhere between half and all of the delay
+	if delay > 1 {
+		jitterMutex.Lock()
+		jitter := time.Duration(jitterSource.Int63n(int64(delay / 2)))
+		jitterMutex.Unlock()
+		delay = delay/2 + jitter
+	}
+
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+/**
+an error that is worth trying again, optionally after a delay that the server asked for
+*/
+type RetryableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+/**
+returns true if the status code means that the request is worth trying again
+*/
+func IsRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case 429, 502, 503, 504:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+returns true if the error is a network problem that is worth trying again: timeouts, dropped connections and DNS
+failures
+*/
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var retryable *RetryableError
+	if errors.As(err, &retryable) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+/**
+reads the Retry-After header, which can be a number of seconds or a date. Returns zero if there isn't a usable one
+*/
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+/**
+makes a RetryableError for a response with a retryable status code, or returns nil if the status code is not retryable.
+If it is retryable the start of the body is read for the error message.
+*/
+func RetryableResponse(resp *http.Response) error {
+	if !IsRetryableStatus(resp.StatusCode) {
+		return nil
+	}
+	return retryableResponse(resp, readSnippet(resp))
+}
+
+/**
+same as RetryableResponse, for when the body has already been read
+*/
+func retryableResponse(resp *http.Response, body []byte) error {
+	if !IsRetryableStatus(resp.StatusCode) {
+		return nil
+	}
+	return &RetryableError{
+		Err:        newResponseError(kindForStatus(resp.StatusCode), resp.StatusCode, body, nil),
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+/**
+calls `fn` until it succeeds, returns an error that isn't worth retrying, or we run out of attempts. `operation` is
+used for logging.
+*/
+func (p RetryPolicy) Do(ctx context.Context, operation string, fn func() error) error {
+	attempt := 1
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !IsRetryableError(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			log.Printf("ERROR %s failed after %d attempts, giving up: %s", operation, attempt, err)
+			return err
+		}
+
+		var retryAfter time.Duration
+		var retryable *RetryableError
+		if errors.As(err, &retryable) {
+			retryAfter = retryable.RetryAfter
+		}
+		delay := p.Delay(attempt, retryAfter)
+		log.Printf("WARN %s failed on attempt %d: %s. Retrying in %s...", operation, attempt, err, delay.Round(time.Millisecond))
+		if sleepErr := SleepContext(ctx, delay); sleepErr != nil {
+			return sleepErr
+		}
+		attempt += 1
+	}
+}
+
+/**
+returns the retry policy to use, the default one if none has been set
+*/
+func (comm *Communicator) RetryPolicy() RetryPolicy {
+	if comm.Retry.MaxAttempts <= 0 {
+		return DefaultRetryPolicy
+	}
+	return comm.Retry
+}
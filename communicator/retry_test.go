@@ -0,0 +1,116 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"github.com/guardian/autopull/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	expectedMax := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, max := range expectedMax {
+		for j := 0; j < 20; j += 1 {
+			delay := policy.Delay(i+1, 0)
+			if delay < max/2 || delay > max {
+				t.Errorf("delay after attempt %d should be between %s and %s, got %s", i+1, max/2, max, delay)
+			}
+		}
+	}
+
+	if delay := policy.Delay(1, 30*time.Second); delay != 30*time.Second {
+		t.Errorf("delay should have followed Retry-After, got %s", delay)
+	}
+	if delay := policy.Delay(1, 24*time.Hour); delay != maxRetryAfter {
+		t.Errorf("delay should have capped Retry-After at %s, got %s", maxRetryAfter, delay)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	if d := ParseRetryAfter("120", now); d != 2*time.Minute {
+		t.Errorf("expected 2m, got %s", d)
+	}
+	if d := ParseRetryAfter("Mon, 01 Jun 2020 12:00:30 GMT", now); d != 30*time.Second {
+		t.Errorf("expected 30s, got %s", d)
+	}
+	if d := ParseRetryAfter("soon", now); d != 0 {
+		t.Errorf("expected 0 for an invalid value, got %s", d)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	if !IsRetryableError(&net.DNSError{Err: "no such host", Name: "example.invalid"}) {
+		t.Errorf("DNS failures should be retryable")
+	}
+	if !IsRetryableError(&url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "dial", Err: timeoutError{}}}) {
+		t.Errorf("timeouts should be retryable")
+	}
+	if IsRetryableError(errors.New("invalid server response")) {
+		t.Errorf("other errors should not be retryable")
+	}
+	if IsRetryableError(context.Canceled) {
+		t.Errorf("cancellation should not be retryable")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRedeemTokenRetries(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount += 1
+		switch requestCount {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+		case 2:
+			w.WriteHeader(503)
+		default:
+			w.Write([]byte(`{"status":"ok","retrievalToken":"LLT","entries":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+	comm := Communicator{
+		ArchiveHunterUri: *serverUrl,
+		Type:             ArchiveHunter,
+		Retry:            RetryPolicy{MaxAttempts: 5, InitialDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	}
+	token := config.DownloadTokenUri{Proto: "archivehunter", Subtype: "bulkdownload", Token: "abc"}
+	info, err := comm.RedeemToken(context.Background(), token)
+	if err != nil {
+		t.Fatalf("RedeemToken should have succeeded after retrying, got %s", err)
+	}
+	if info.RetrievalToken != "LLT" || requestCount != 3 {
+		t.Errorf("expected 3 requests and token LLT, got %d requests and %v", requestCount, info)
+	}
+
+	//a server that never recovers must be given up on
+	failCount := 0
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failCount += 1
+		w.WriteHeader(502)
+	}))
+	defer failingServer.Close()
+	failingUrl, _ := url.Parse(failingServer.URL)
+	comm.ArchiveHunterUri = *failingUrl
+	comm.Retry.MaxAttempts = 3
+	if _, err := comm.RedeemToken(context.Background(), token); err == nil {
+		t.Errorf("RedeemToken should have given up")
+	}
+	if failCount != 3 {
+		t.Errorf("expected 3 attempts, got %d", failCount)
+	}
+}
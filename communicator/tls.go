@@ -0,0 +1,93 @@
+package communicator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/**
+extra TLS settings for talking to servers whose certificates are signed by a CA that isn't installed on this computer,
+or that want a client certificate
+*/
+type TLSSettings struct {
+	CABundle   string //PEM file of extra CA certificates to trust, on top of the system ones
+	ClientCert string //PEM file with a client certificate to present to the server
+	ClientKey  string //PEM file with the private key for ClientCert
+	MinVersion string //lowest TLS version to accept, "1.0" to "1.3"
+}
+
+func (s TLSSettings) IsEmpty() bool {
+	return s.CABundle == "" && s.ClientCert == "" && s.ClientKey == "" && s.MinVersion == ""
+}
+
+/**
+turns a version string like "1.2" into the constant that crypto/tls wants
+*/
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls") {
+	case "1.0", "1":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("'%s' is not a TLS version, expected one of 1.0, 1.1, 1.2 or 1.3", version)
+	}
+}
+
+/**
+builds a tls.Config from the settings, loading and checking all of the files they point to.
+returns nil with no error if there is nothing to change from the defaults.
+*/
+func NewTLSConfig(settings TLSSettings) (*tls.Config, error) {
+	if settings.IsEmpty() {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+
+	if settings.MinVersion != "" {
+		version, versionErr := ParseTLSVersion(settings.MinVersion)
+		if versionErr != nil {
+			return nil, versionErr
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if settings.CABundle != "" {
+		//the bundle is meant to be added to the system certificates, so carrying on without them would break
+		//every server that used to work. Older Go versions can't load them on Windows at all.
+		pool, poolErr := x509.SystemCertPool()
+		if poolErr != nil {
+			return nil, fmt.Errorf("could not load the system certificates to add the CA bundle to: %s", poolErr)
+		} else if pool == nil {
+			return nil, errors.New("could not load the system certificates to add the CA bundle to")
+		}
+		content, readErr := ioutil.ReadFile(settings.CABundle)
+		if readErr != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %s", readErr)
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", settings.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.ClientCert != "" || settings.ClientKey != "" {
+		if settings.ClientCert == "" || settings.ClientKey == "" {
+			return nil, errors.New("a client certificate needs both client_cert and client_key to be set")
+		}
+		cert, certErr := tls.LoadX509KeyPair(settings.ClientCert, settings.ClientKey)
+		if certErr != nil {
+			return nil, fmt.Errorf("could not load client certificate: %s", certErr)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
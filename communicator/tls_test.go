@@ -0,0 +1,92 @@
+package communicator
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	expected := map[string]uint16{
+		"1.0":     tls.VersionTLS10,
+		"1.2":     tls.VersionTLS12,
+		"TLS1.3":  tls.VersionTLS13,
+		" 1.1 ":   tls.VersionTLS11,
+		"tls1.2":  tls.VersionTLS12,
+		"1.3":     tls.VersionTLS13,
+		"1":       tls.VersionTLS10,
+		"1.1":     tls.VersionTLS11,
+		"tls 1.2": 0,
+		"2.0":     0,
+		"":        0,
+	}
+	for input, version := range expected {
+		result, err := ParseTLSVersion(input)
+		if version == 0 {
+			if err == nil {
+				t.Errorf("expected an error for '%s'", input)
+			}
+		} else if err != nil || result != version {
+			t.Errorf("expected %x for '%s', got %x (%v)", version, input, result, err)
+		}
+	}
+}
+
+func TestNewTLSConfigCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-tls")
+	defer os.RemoveAll(tempDir)
+
+	//without the server's certificate the request must fail
+	if response, err := NewHttpClient(DefaultHttpSettings).Get(server.URL); err == nil {
+		response.Body.Close()
+		t.Fatal("expected the request to fail without the CA bundle")
+	}
+
+	bundlePath := filepath.Join(tempDir, "ca.pem")
+	pemContent := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(bundlePath, pemContent, 0644)
+
+	tlsConfig, err := NewTLSConfig(TLSSettings{CABundle: bundlePath, MinVersion: "1.2"})
+	if err != nil {
+		t.Fatalf("could not build TLS config: %s", err)
+	}
+	settings := DefaultHttpSettings
+	settings.TLSConfig = tlsConfig
+	response, getErr := NewHttpClient(settings).Get(server.URL)
+	if getErr != nil {
+		t.Fatalf("request failed with the CA bundle: %s", getErr)
+	}
+	response.Body.Close()
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-tls")
+	defer os.RemoveAll(tempDir)
+	notPem := filepath.Join(tempDir, "notpem.txt")
+	ioutil.WriteFile(notPem, []byte("hello"), 0644)
+
+	if config, err := NewTLSConfig(TLSSettings{}); err != nil || config != nil {
+		t.Errorf("empty settings should give no config, got %v %v", config, err)
+	}
+	bad := []TLSSettings{
+		{CABundle: filepath.Join(tempDir, "missing.pem")},
+		{CABundle: notPem},
+		{ClientCert: notPem},
+		{ClientKey: notPem},
+		{ClientCert: notPem, ClientKey: notPem},
+		{MinVersion: "1.4"},
+	}
+	for _, settings := range bad {
+		if _, err := NewTLSConfig(settings); err == nil {
+			t.Errorf("expected an error for %+v", settings)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+a time of day during which a different bandwidth limit applies. If `to` is earlier than `from` then the window runs
+over midnight.
+*/
+type BandwidthWindow struct {
+	From         string `yaml:"from"`          //e.g. "08:00"
+	To           string `yaml:"to"`            //e.g. "18:30"
+	MaxBandwidth string `yaml:"max_bandwidth"` //e.g. "5MiB/s", or "unlimited"
+}
+
+/**
+parses a rate like "50MiB/s" into bytes per second. An empty value, "0" or "unlimited" means no limit and returns 0.
+Rates like "50Mbps" are refused, because they usually mean megabits and would be 8 times faster than intended if read
+as bytes.
+*/
+func ParseBandwidth(value string) (int64, error) {
+	trimmed := strings.TrimSpace(strings.ToLower(value))
+	if trimmed == "" || trimmed == "unlimited" {
+		return 0, nil
+	}
+	if strings.HasSuffix(trimmed, "bps") {
+		return 0, fmt.Errorf("'%s' is ambiguous between bits and bytes, give the rate in bytes per second like 6MiB/s", value)
+	}
+	trimmed = strings.TrimSuffix(trimmed, "/s")
+	rate, err := ParseByteSize(trimmed)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a valid bandwidth, expected something like 50MiB/s", value)
+	}
+	return rate, nil
+}
+
+type parsedWindow struct {
+	from int //minutes since midnight
+	to   int
+	rate int64
+}
+
+/**
+works out the bandwidth limit in force at any time of day from the max_bandwidth and bandwidth_schedule settings
+*/
+type BandwidthPolicy struct {
+	defaultRate int64
+	windows     []parsedWindow
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a valid time of day, expected something like 18:30", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func NewBandwidthPolicy(defaultRate string, schedule []BandwidthWindow) (*BandwidthPolicy, error) {
+	rate, rateErr := ParseBandwidth(defaultRate)
+	if rateErr != nil {
+		return nil, rateErr
+	}
+	policy := &BandwidthPolicy{defaultRate: rate, windows: make([]parsedWindow, len(schedule))}
+	for i, window := range schedule {
+		from, fromErr := parseTimeOfDay(window.From)
+		if fromErr != nil {
+			return nil, fromErr
+		}
+		to, toErr := parseTimeOfDay(window.To)
+		if toErr != nil {
+			return nil, toErr
+		}
+		windowRate, windowRateErr := ParseBandwidth(window.MaxBandwidth)
+		if windowRateErr != nil {
+			return nil, windowRateErr
+		}
+		policy.windows[i] = parsedWindow{from: from, to: to, rate: windowRate}
+	}
+	return policy, nil
+}
+
+/**
+returns the limit in bytes per second at the given time, or 0 for no limit. If windows overlap the first one in the
+schedule wins.
+*/
+func (p *BandwidthPolicy) RateAt(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range p.windows {
+		var inWindow bool
+		if window.from <= window.to {
+			inWindow = minute >= window.from && minute < window.to
+		} else {
+			inWindow = minute >= window.from || minute < window.to
+		}
+		if inWindow {
+			return window.rate
+		}
+	}
+	return p.defaultRate
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	valid := map[string]int64{
+		"":          0,
+		"unlimited": 0,
+		"50MiB/s":   50 * 1024 * 1024,
+		"10MB/s":    10 * 1024 * 1024,
+		"512k":      512 * 1024,
+	}
+	for input, expected := range valid {
+		result, err := ParseBandwidth(input)
+		if err != nil {
+			t.Errorf("ParseBandwidth(%q) returned unexpected error %s", input, err)
+		} else if result != expected {
+			t.Errorf("ParseBandwidth(%q) returned %d, expected %d", input, result, expected)
+		}
+	}
+	for _, input := range []string{"fast", "50Mbps", "50MBps", "100kbps"} {
+		if _, err := ParseBandwidth(input); err == nil {
+			t.Errorf("ParseBandwidth should have rejected '%s'", input)
+		}
+	}
+}
+
+func TestBandwidthPolicy(t *testing.T) {
+	policy, err := NewBandwidthPolicy("5MiB/s", []BandwidthWindow{
+		{From: "19:00", To: "07:00", MaxBandwidth: "unlimited"},
+		{From: "12:00", To: "13:00", MaxBandwidth: "10MiB/s"},
+	})
+	if err != nil {
+		t.Fatalf("NewBandwidthPolicy returned unexpected error %s", err)
+	}
+
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	expected := map[time.Time]int64{
+		at(9, 0):   5 * 1024 * 1024,
+		at(12, 30): 10 * 1024 * 1024,
+		at(13, 0):  5 * 1024 * 1024,
+		at(18, 59): 5 * 1024 * 1024,
+		at(19, 0):  0,
+		at(23, 59): 0,
+		at(3, 0):   0,
+		at(7, 0):   5 * 1024 * 1024,
+	}
+	for when, rate := range expected {
+		if result := policy.RateAt(when); result != rate {
+			t.Errorf("RateAt(%s) returned %d, expected %d", when.Format("15:04"), result, rate)
+		}
+	}
+
+	if _, err := NewBandwidthPolicy("", []BandwidthWindow{{From: "25:00", To: "07:00"}}); err == nil {
+		t.Errorf("NewBandwidthPolicy should have rejected an invalid time")
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var byteSizeMatcher = regexp.MustCompile(`^\s*([0-9]+(?:\.[0-9]+)?)\s*([A-Za-z]*)\s*$`)
+
+/**
+parses a size like "500", "64MiB", "10 GB" or "1.5T". Sizes are in powers of 1024, whether or not the unit is written
+with an "i", to match how sizes are shown elsewhere.
+*/
+func ParseByteSize(value string) (int64, error) {
+	matches := byteSizeMatcher.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("'%s' is not a valid size", value)
+	}
+	number, parseErr := strconv.ParseFloat(matches[1], 64)
+	if parseErr != nil {
+		return 0, fmt.Errorf("'%s' is not a valid size: %s", value, parseErr)
+	}
+
+	var multiplier float64
+	switch strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(matches[2]), "b"), "i") {
+	case "":
+		multiplier = 1
+	case "k":
+		multiplier = 1024
+	case "m":
+		multiplier = 1024 * 1024
+	case "g":
+		multiplier = 1024 * 1024 * 1024
+	case "t":
+		multiplier = 1024 * 1024 * 1024 * 1024
+	default:
+		return 0, fmt.Errorf("'%s' is not a valid size, unrecognised unit '%s'", value, matches[2])
+	}
+
+	result := number * multiplier
+	if result > math.MaxInt64 {
+		return 0, fmt.Errorf("'%s' is too large", value)
+	}
+	return int64(result), nil
+}
@@ -0,0 +1,33 @@
+package config
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	valid := map[string]int64{
+		"0":       0,
+		"500":     500,
+		"500b":    500,
+		"64MiB":   64 * 1024 * 1024,
+		"64MB":    64 * 1024 * 1024,
+		"64m":     64 * 1024 * 1024,
+		"10 GB":   10 * 1024 * 1024 * 1024,
+		"1.5k":    1536,
+		" 2TiB ":  2 * 1024 * 1024 * 1024 * 1024,
+		"1024KiB": 1024 * 1024,
+	}
+	for input, expected := range valid {
+		result, err := ParseByteSize(input)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q) returned unexpected error %s", input, err)
+		} else if result != expected {
+			t.Errorf("ParseByteSize(%q) returned %d, expected %d", input, result, expected)
+		}
+	}
+
+	invalid := []string{"", "abc", "-5MB", "10 parsecs", "1.2.3GB", "100000000000TB"}
+	for _, input := range invalid {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q) should have failed", input)
+		}
+	}
+}
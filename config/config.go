@@ -8,13 +8,48 @@ import (
 )
 
 type Configuration struct {
-	VaultDoorUri     string `yaml:"vaultdoor_uri"`
-	ArchiveHunterUri string `yaml:"archivehunter_uri"`
-	DownloadThreads  int    `yaml:"download_threads"`  //defaults to 5 if not specified
-	QueueBufferSize  int    `yaml:"queue_buffer_size"` //defaults to 10 if not specified
-	AllowOverwrite   bool   `yaml:"allow_overwrite"`   //defaults to false
-	DownloadPath     string `yaml:"download_path"`     //path to download to. Can be overridden on the commandline.
-	NoWait           bool   `yaml:"immediate_exit"`    //set to False on windows so you can see the result before the window shuts
+	VaultDoorUri           string            `yaml:"vaultdoor_uri"`
+	ArchiveHunterUri       string            `yaml:"archivehunter_uri"`
+	DownloadThreads        int               `yaml:"download_threads"`          //defaults to 5 if not specified
+	QueueBufferSize        int               `yaml:"queue_buffer_size"`         //defaults to 10 if not specified
+	AllowOverwrite         bool              `yaml:"allow_overwrite"`           //deprecated, use conflict_policy. Only used if conflict_policy is not set, true means "overwrite" and false means "skip"
+	ConflictPolicy         string            `yaml:"conflict_policy"`           //skip, overwrite, overwrite-if-different, rename or fail-run. Defaults to skip
+	DownloadPath           string            `yaml:"download_path"`             //path to download to. Can be overridden on the commandline.
+	NoWait                 bool              `yaml:"immediate_exit"`            //set to False on windows so you can see the result before the window shuts
+	RestorePollInterval    int               `yaml:"restore_poll_interval"`     //seconds between checks on items that are still restoring. Defaults to 60
+	RestorePollMaxInterval int               `yaml:"restore_poll_max_interval"` //the interval backs off up to this many seconds. Defaults to 900
+	RestoreMaxWait         int               `yaml:"restore_max_wait"`          //minutes to wait for restores to complete. Defaults to 720, set to -1 to not wait
+	ReportPath             string            `yaml:"report_path"`               //if set, write a JSON report of each run to this path. Can be overridden on the commandline.
+	FilenameMapping        string            `yaml:"filename_mapping"`          //"portable" to rewrite names that Windows or network shares can't take, or "none". Defaults to portable
+	RestoreTier            string            `yaml:"restore_tier"`              //standard, bulk or expedited retrieval for items that need restoring, or "none" to not request restores. Defaults to standard
+	SegmentThreshold       string            `yaml:"segment_threshold"`         //files at least this big, e.g. "10GiB", are downloaded in segments over several connections. Not set means never.
+	SegmentSize            string            `yaml:"segment_size"`              //size of each segment. Defaults to 64MiB
+	SegmentStreams         int               `yaml:"segment_streams"`           //how many segments of a file to download at once. Defaults to 4
+	MaxBandwidth           string            `yaml:"max_bandwidth"`             //total download rate limit, e.g. "50MiB/s". Not set means unlimited. Can be overridden on the commandline.
+	BandwidthSchedule      []BandwidthWindow `yaml:"bandwidth_schedule"`        //times of day when a different max_bandwidth applies
+	DiskSpaceCheck         string            `yaml:"disk_space_check"`          //what to do if the downloads won't fit in the download folder: abort, warn or off. Defaults to abort
+	Include                []string          `yaml:"include"`                   //only download entries whose paths match one of these glob patterns (or regular expressions prefixed with "re:")
+	Exclude                []string          `yaml:"exclude"`                   //don't download entries whose paths match any of these
+	MinSize                string            `yaml:"min_size"`                  //don't download entries smaller than this, e.g. "10MB"
+	MaxSize                string            `yaml:"max_size"`                  //don't download entries larger than this
+	RetryMaxAttempts       int               `yaml:"retry_max_attempts"`        //how many times to try a request to the server before giving up. Defaults to 10
+	RetryInitialDelay      int               `yaml:"retry_initial_delay"`       //seconds to wait after the first failure. The wait doubles each time. Defaults to 2
+	RetryMaxDelay          int               `yaml:"retry_max_delay"`           //the longest to wait between attempts, in seconds. Defaults to 120
+	ConnectTimeout         int               `yaml:"connect_timeout"`           //seconds to wait for a connection to a server. Defaults to 30
+	TLSHandshakeTimeout    int               `yaml:"tls_handshake_timeout"`     //seconds to wait for the TLS handshake. Defaults to 30
+	ResponseHeaderTimeout  int               `yaml:"response_header_timeout"`   //seconds to wait for a server to start responding to a request. Defaults to 60
+	IdleReadTimeout        int               `yaml:"idle_read_timeout"`         //drop a connection if nothing is received on it for this many seconds. Defaults to 120
+	CABundle               string            `yaml:"ca_bundle"`                 //PEM file of extra CA certificates to trust when connecting to the servers, on top of the system ones
+	ClientCert             string            `yaml:"client_cert"`               //PEM file with a client certificate to present to the servers
+	ClientKey              string            `yaml:"client_key"`                //PEM file with the private key for client_cert
+	MinTLSVersion          string            `yaml:"min_tls_version"`           //lowest TLS version to accept, 1.0 to 1.3. Defaults to the Go default
+	Proxy                  string            `yaml:"proxy"`                     //proxy url (http://, https:// or socks5://) for everything that doesn't have its own setting below. Defaults to the HTTP_PROXY etc. environment variables
+	VaultDoorProxy         string            `yaml:"vaultdoor_proxy"`           //proxy url for VaultDoor, or "direct" to connect without one
+	ArchiveHunterProxy     string            `yaml:"archivehunter_proxy"`       //proxy url for ArchiveHunter, or "direct" to connect without one
+	DownloadProxy          string            `yaml:"download_proxy"`            //proxy url for downloading the files themselves, or "direct" to connect without one
+	NoProxy                []string          `yaml:"no_proxy"`                  //hosts, domains, IP addresses or CIDR ranges to always connect to without a proxy
+	ProxyUsername          string            `yaml:"proxy_username"`            //username for the proxy, if it needs one
+	ProxyPassword          string            `yaml:"proxy_password"`            //password for the proxy
 }
 
 func LoadConfig(path string) (conf *Configuration, err error) {
@@ -2,16 +2,28 @@ package config
 
 import (
 	"errors"
+	"net/url"
 	"strings"
 )
 
 type DownloadTokenUri struct {
-	Proto   string //must be "archivehunter"
-	Subtype string //expect "vaultdownload" for VaultDoor
-	Token   string //long-lived token
+	Proto   string     //must be "archivehunter"
+	Subtype string     //expect "vaultdownload" for VaultDoor
+	Token   string     //long-lived token
+	Query   url.Values //optional settings after a ?, e.g. archivehunter:bulkdownload:{token}?include=*.mov&min_size=1GB
 }
 
 func ParseArchiveHunterUri(content string) (DownloadTokenUri, error) {
+	var query url.Values
+	if queryStart := strings.Index(content, "?"); queryStart >= 0 {
+		var queryErr error
+		query, queryErr = url.ParseQuery(content[queryStart+1:])
+		if queryErr != nil {
+			return DownloadTokenUri{}, queryErr
+		}
+		content = content[:queryStart]
+	}
+
 	parts := strings.Split(content, ":")
 	if len(parts) != 3 {
 		return DownloadTokenUri{}, errors.New("not enough parts to split")
@@ -21,6 +33,7 @@ func ParseArchiveHunterUri(content string) (DownloadTokenUri, error) {
 		Proto:   parts[0],
 		Subtype: parts[1],
 		Token:   parts[2],
+		Query:   query,
 	}
 	return rtn, nil
 }
@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+func TestParseArchiveHunterUri(t *testing.T) {
+	plain, err := ParseArchiveHunterUri("archivehunter:bulkdownload:abcd")
+	if err != nil || plain.Token != "abcd" || !plain.ValidateArchiveHunter() || len(plain.Query) != 0 {
+		t.Errorf("unexpected result parsing a plain uri: %v, %s", plain, err)
+	}
+
+	withQuery, err := ParseArchiveHunterUri("archivehunter:vaultdownload:abcd?include=*.mov&include=re%3A%5Ecard1%2F&min_size=1GB")
+	if err != nil {
+		t.Fatalf("unexpected error parsing a uri with a query: %s", err)
+	}
+	if withQuery.Token != "abcd" || !withQuery.ValidateVaultDoor() {
+		t.Errorf("unexpected token parsing a uri with a query: %v", withQuery)
+	}
+	if includes := withQuery.Query["include"]; len(includes) != 2 || includes[0] != "*.mov" || includes[1] != "re:^card1/" {
+		t.Errorf("unexpected include values %v", includes)
+	}
+	if withQuery.Query.Get("min_size") != "1GB" {
+		t.Errorf("unexpected min_size value %s", withQuery.Query.Get("min_size"))
+	}
+
+	if _, err := ParseArchiveHunterUri("archivehunter:abcd"); err == nil {
+		t.Errorf("ParseArchiveHunterUri should have rejected a uri with too few parts")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/guardian/autopull/downloadmanager"
+	"log"
+)
+
+//exit code for when the files won't fit in the download folder
+const ExitInsufficientSpace = 11
+
+/**
+checks that there is room in the download folder for everything that is going to be downloaded, according to the
+disk_space_check setting ("abort", "warn" or "off"). Returns false if the run should not go ahead
+*/
+func checkDiskSpace(mode string, downloadPath string, bytesNeeded int64) bool {
+	if mode == "off" {
+		return true
+	}
+
+	freeSpace, spaceErr := downloadmanager.FreeSpaceFor(downloadPath)
+	if spaceErr != nil {
+		log.Printf("WARN main could not check the free space in %s: %s", downloadPath, spaceErr)
+		return true
+	}
+	if bytesNeeded <= 0 || uint64(bytesNeeded) <= freeSpace {
+		log.Printf("INFO main %s needed, %s free in %s", FormatByteSize(bytesNeeded, 0), FormatByteSize(int64(freeSpace), 0), downloadPath)
+		return true
+	}
+
+	if mode == "warn" {
+		log.Printf("WARN main these files need %s but there is only %s free in %s. Downloads will stop when it fills up.", FormatByteSize(bytesNeeded, 0), FormatByteSize(int64(freeSpace), 0), downloadPath)
+		return true
+	}
+	log.Printf("ERROR main these files need %s but there is only %s free in %s. Free up %s or download somewhere else with --to. Set `disk_space_check: warn` to start anyway.",
+		FormatByteSize(bytesNeeded, 0), FormatByteSize(int64(freeSpace), 0), downloadPath, FormatByteSize(bytesNeeded-int64(freeSpace), 0))
+	return false
+}
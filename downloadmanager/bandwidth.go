@@ -0,0 +1,120 @@
+package downloadmanager
+
+import (
+	"context"
+	"github.com/guardian/autopull/communicator"
+	"io"
+	"sync"
+	"time"
+)
+
+/**
+token bucket shared between all of the downloads, keeping the total download rate under a limit. Each read books the
+next free slot in time, so readers take it in turns and the bandwidth is divided fairly between them.
+A nil limiter does not limit anything, and the rate can be changed at any time.
+*/
+type BandwidthLimiter struct {
+	mutex sync.Mutex
+	rate  int64     //bytes per second, zero means unlimited
+	next  time.Time //when the bandwidth that has been booked so far will have been used up
+}
+
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bytesPerSecond}
+}
+
+/**
+changes the limit, taking effect straight away. Zero means unlimited
+*/
+func (l *BandwidthLimiter) SetRate(bytesPerSecond int64) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = bytesPerSecond
+	l.next = time.Now()
+}
+
+func (l *BandwidthLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+/**
+books `count` bytes and waits until the limit allows them
+*/
+func (l *BandwidthLimiter) wait(ctx context.Context, count int) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		//unused bandwidth is not saved up
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(count) * time.Second / time.Duration(l.rate))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	return communicator.SleepContext(ctx, delay)
+}
+
+/**
+returns the largest read to allow in one go, so that readers get turns often enough to share the bandwidth smoothly
+*/
+func (l *BandwidthLimiter) chunkSize() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	chunk := l.rate / 20
+	if chunk < 1024 {
+		chunk = 1024
+	} else if chunk > 64*1024 {
+		chunk = 64 * 1024
+	}
+	return int(chunk)
+}
+
+/**
+wraps the given reader so that reading from it counts against the limit
+*/
+func (l *BandwidthLimiter) WrapReader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, reader: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunkSize(); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
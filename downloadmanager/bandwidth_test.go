@@ -0,0 +1,38 @@
+package downloadmanager
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := NewBandwidthLimiter(100 * 1024)
+
+	//two readers of 20KiB each at 100KiB/s between them should take about 0.4s
+	startTime := time.Now()
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(2)
+	for i := 0; i < 2; i += 1 {
+		go func() {
+			defer waitGroup.Done()
+			io.Copy(ioutil.Discard, limiter.WrapReader(context.Background(), bytes.NewReader(make([]byte, 20*1024))))
+		}()
+	}
+	waitGroup.Wait()
+	elapsed := time.Since(startTime)
+	if elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected limited reads to take about 400ms, took %s", elapsed)
+	}
+
+	limiter.SetRate(0)
+	startTime = time.Now()
+	io.Copy(ioutil.Discard, limiter.WrapReader(context.Background(), bytes.NewReader(make([]byte, 1024*1024))))
+	if time.Since(startTime) > 200*time.Millisecond {
+		t.Errorf("unlimited reads should not have been slowed down")
+	}
+}
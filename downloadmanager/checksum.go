@@ -0,0 +1,144 @@
+package downloadmanager
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+//the downloaded content did not match the checksum that the server gave for it
+var ChecksumMismatch = errors.New("downloaded content did not match the server checksum")
+
+type expectedChecksum struct {
+	Algorithm string //"md5" or "sha256"
+	Value     []byte
+}
+
+func (c *expectedChecksum) String() string {
+	return fmt.Sprintf("%s:%s", c.Algorithm, hex.EncodeToString(c.Value))
+}
+
+func (c *expectedChecksum) newHash() hash.Hash {
+	switch c.Algorithm {
+	case "sha256":
+		return sha256.New()
+	default:
+		return md5.New()
+	}
+}
+
+/**
+returns true if the given hasher has computed the checksum we expected
+*/
+func (c *expectedChecksum) matches(h hash.Hash) bool {
+	return bytes.Equal(c.Value, h.Sum(nil))
+}
+
+/**
+decodes a checksum value that could be either hex or base64 encoded
+*/
+func decodeChecksumValue(value string, expectedLength int) []byte {
+	if decoded, hexErr := hex.DecodeString(value); hexErr == nil && len(decoded) == expectedLength {
+		return decoded
+	}
+	if decoded, b64Err := base64.StdEncoding.DecodeString(value); b64Err == nil && len(decoded) == expectedLength {
+		return decoded
+	}
+	return nil
+}
+
+/**
+parses a checksum from the server. This can be of the form "sha256:{value}" or "md5:{value}", or just a bare value in
+which case we guess the algorithm from the length. Values can be either hex or base64 encoded.
+returns nil if the checksum can't be understood
+*/
+func parseChecksum(raw string) *expectedChecksum {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+
+	var algorithms []string
+	value := raw
+	if colonPos := strings.Index(raw, ":"); colonPos > 0 {
+		algorithms = []string{strings.Replace(strings.ToLower(raw[:colonPos]), "-", "", -1)}
+		value = raw[colonPos+1:]
+	} else {
+		algorithms = []string{"sha256", "md5"}
+	}
+
+	for _, algo := range algorithms {
+		var length int
+		switch algo {
+		case "sha256":
+			length = sha256.Size
+		case "md5":
+			length = md5.Size
+		default:
+			return nil
+		}
+		if decoded := decodeChecksumValue(value, length); decoded != nil {
+			return &expectedChecksum{Algorithm: algo, Value: decoded}
+		}
+	}
+	return nil
+}
+
+/**
+an S3 ETag is the MD5 of the content, unless the object was a multipart upload in which case it has a "-{parts}"
+suffix and can't be checked without knowing the part size.
+returns nil if the etag can't be used as a checksum
+*/
+func parseETag(etag string) *expectedChecksum {
+	etag = strings.Trim(strings.TrimSpace(etag), "\"")
+	if etag == "" || strings.Contains(etag, "-") {
+		return nil
+	}
+	decoded := decodeChecksumValue(etag, md5.Size)
+	if decoded == nil {
+		return nil
+	}
+	return &expectedChecksum{Algorithm: "md5", Value: decoded}
+}
+
+/**
+works out the best checksum that we have available for the given item, preferring a proper checksum over the ETag.
+returns nil if there is nothing to check against
+*/
+func pickChecksum(entry *communicator.ArchiveEntryDownloadSynopsis, linkInfo *communicator.DownloadManagerItemResponse) *expectedChecksum {
+	candidates := []*expectedChecksum{
+		parseChecksum(linkInfo.Checksum),
+		parseChecksum(entry.Checksum),
+		parseETag(linkInfo.ETag),
+		parseETag(entry.ETag),
+	}
+	for _, c := range candidates {
+		if c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+/**
+feeds the first `length` bytes of the given file into the hasher, so that we can carry on from there when resuming
+*/
+func hashExistingContent(h hash.Hash, filePath string, length int64) error {
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	_, copyErr := io.CopyN(h, file, length)
+	return copyErr
+}
@@ -0,0 +1,43 @@
+package downloadmanager
+
+import (
+	"crypto/md5"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sha := parseChecksum("sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	if sha == nil || sha.Algorithm != "sha256" {
+		t.Errorf("parseChecksum should have recognised a prefixed sha256 but got %v", sha)
+	}
+
+	bare := parseChecksum("5d41402abc4b2a76b9719d911017c592")
+	if bare == nil || bare.Algorithm != "md5" {
+		t.Errorf("parseChecksum should have recognised a bare md5 but got %v", bare)
+	}
+
+	b64 := parseChecksum("md5:XUFAKrxLKna5cZ2REBfFkg==")
+	if b64 == nil || b64.String() != "md5:5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("parseChecksum should have decoded a base64 md5 but got %v", b64)
+	}
+
+	if parseChecksum("crc32:abcd") != nil {
+		t.Errorf("parseChecksum should have rejected an unknown algorithm")
+	}
+}
+
+func TestParseETag(t *testing.T) {
+	etag := parseETag("\"5d41402abc4b2a76b9719d911017c592\"")
+	if etag == nil {
+		t.Fatalf("parseETag should have accepted a single-part etag")
+	}
+	h := md5.New()
+	h.Write([]byte("hello"))
+	if !etag.matches(h) {
+		t.Errorf("etag checksum should have matched the content")
+	}
+
+	if parseETag("\"d41d8cd98f00b204e9800998ecf8427e-12\"") != nil {
+		t.Errorf("parseETag should have rejected a multipart etag")
+	}
+}
@@ -0,0 +1,148 @@
+package downloadmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type ConflictPolicy string
+
+const (
+	ConflictSkip                 ConflictPolicy = "skip"                   //leave the existing file alone
+	ConflictOverwrite            ConflictPolicy = "overwrite"              //always replace the existing file
+	ConflictOverwriteIfDifferent ConflictPolicy = "overwrite-if-different" //replace the existing file if its size or checksum don't match
+	ConflictRename               ConflictPolicy = "rename"                 //download to "name (1).ext" alongside the existing file
+	ConflictFailRun              ConflictPolicy = "fail-run"               //stop the whole run
+)
+
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	policy := ConflictPolicy(strings.ToLower(name))
+	switch policy {
+	case ConflictSkip, ConflictOverwrite, ConflictOverwriteIfDifferent, ConflictRename, ConflictFailRun:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid conflict policy, expected skip, overwrite, overwrite-if-different, rename or fail-run", name)
+	}
+}
+
+//returned by PerformDownload when there is already a file at the target path and the policy is to leave it alone
+var FileExists = errors.New("file already exists")
+
+//returned by PerformDownload when there is already a file at the target path and the policy is fail-run
+var FileConflict = errors.New("file already exists and conflict_policy is fail-run")
+
+/**
+works out what to do about a file that might already exist at pathTarget, according to the policy.
+returns the path to download to, which is different to pathTarget if the policy is rename, or FileExists if the
+download should be skipped
+*/
+func resolveConflict(pathTarget string, expectedSize int64, checksum *expectedChecksum, policy ConflictPolicy) (string, error) {
+	info, statErr := os.Stat(pathTarget)
+	if statErr != nil {
+		if os.IsNotExist(statErr) {
+			return pathTarget, nil
+		}
+		log.Printf("ERROR DownloadManager.resolveConflict could not check for existence of file: %s", statErr)
+		return "", statErr
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		log.Printf("INFO DownloadManager.resolveConflict overwriting existing file %s", pathTarget)
+		return pathTarget, nil
+	case ConflictOverwriteIfDifferent:
+		same, compareErr := localFileMatches(pathTarget, info, expectedSize, checksum)
+		if compareErr != nil {
+			return "", compareErr
+		}
+		if same {
+			log.Printf("INFO DownloadManager.resolveConflict %s is already present and matches, skipping", pathTarget)
+			return "", FileExists
+		}
+		log.Printf("INFO DownloadManager.resolveConflict %s exists but is different, overwriting", pathTarget)
+		return pathTarget, nil
+	case ConflictRename:
+		renamed, renameErr := findFreeName(pathTarget, expectedSize)
+		if renameErr != nil {
+			return "", renameErr
+		}
+		log.Printf("INFO DownloadManager.resolveConflict %s already exists, downloading to %s instead", pathTarget, renamed)
+		return renamed, nil
+	case ConflictFailRun:
+		log.Printf("ERROR DownloadManager.resolveConflict %s already exists, stopping the run", pathTarget)
+		return "", FileConflict
+	default:
+		log.Printf("INFO DownloadManager.resolveConflict %s already exists, skipping", pathTarget)
+		return "", FileExists
+	}
+}
+
+/**
+checks whether the existing file is the same as the one on the server. We don't get a modification time from the
+server, so this goes on the size and, if we have one, the checksum.
+*/
+func localFileMatches(pathTarget string, info os.FileInfo, expectedSize int64, checksum *expectedChecksum) (bool, error) {
+	if info.Size() != expectedSize {
+		return false, nil
+	}
+	if checksum == nil {
+		return true, nil
+	}
+
+	hasher := checksum.newHash()
+	if hashErr := hashExistingContent(hasher, pathTarget, info.Size()); hashErr != nil {
+		log.Printf("ERROR DownloadManager.localFileMatches could not read %s to compare it: %s", pathTarget, hashErr)
+		return false, hashErr
+	}
+	return checksum.matches(hasher), nil
+}
+
+/**
+finds the first of "name (1).ext", "name (2).ext" etc. that doesn't exist yet. A name with a partial download that
+could be this file is used too, so that a re-run carries on with the download that an earlier run started there.
+*/
+func findFreeName(pathTarget string, expectedSize int64) (string, error) {
+	ext := filepath.Ext(pathTarget)
+	stem := strings.TrimSuffix(pathTarget, ext)
+	for i := 1; i < 10000; i += 1 {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		_, statErr := os.Stat(candidate)
+		if os.IsNotExist(statErr) {
+			partialTarget := partialPath(candidate)
+			if _, partialErr := os.Stat(partialTarget); os.IsNotExist(partialErr) {
+				return candidate, nil
+			} else if partialCouldBelongTo(partialTarget, expectedSize) {
+				log.Printf("INFO DownloadManager.findFreeName carrying on with the partial download %s", partialTarget)
+				return candidate, nil
+			}
+			//otherwise something else is being downloaded to it
+		} else if statErr != nil {
+			return "", statErr
+		}
+	}
+	return "", fmt.Errorf("could not find a free name for %s", pathTarget)
+}
+
+/**
+checks whether the partial download at partialTarget could be the start of a file of expectedSize
+*/
+func partialCouldBelongTo(partialTarget string, expectedSize int64) bool {
+	info, statErr := os.Stat(partialTarget)
+	if statErr != nil || info.Size() > expectedSize {
+		return false
+	}
+	content, readErr := ioutil.ReadFile(segmentsPath(partialTarget))
+	if readErr == nil {
+		var record segmentState
+		if json.Unmarshal(content, &record) != nil || record.FileSize != expectedSize {
+			return false
+		}
+	}
+	return true
+}
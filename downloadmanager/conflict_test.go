@@ -0,0 +1,67 @@
+package downloadmanager
+
+import (
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveConflict(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+
+	content := []byte("some existing content")
+	existing := filepath.Join(tempDir, "clip.mov")
+	ioutil.WriteFile(existing, content, 0644)
+	sum := md5.Sum(content)
+	matchingChecksum := &expectedChecksum{Algorithm: "md5", Value: sum[:]}
+
+	notThere := filepath.Join(tempDir, "other.mov")
+	if target, err := resolveConflict(notThere, 10, nil, ConflictSkip); target != notThere || err != nil {
+		t.Errorf("resolveConflict should have used the path of a file that doesn't exist but got %s, %s", target, err)
+	}
+
+	if _, err := resolveConflict(existing, 10, nil, ConflictSkip); err != FileExists {
+		t.Errorf("resolveConflict should have skipped an existing file but got %v", err)
+	}
+
+	if _, err := resolveConflict(existing, 10, nil, ConflictFailRun); err != FileConflict {
+		t.Errorf("resolveConflict should have failed on an existing file but got %v", err)
+	}
+
+	if target, err := resolveConflict(existing, 10, nil, ConflictOverwrite); target != existing || err != nil {
+		t.Errorf("resolveConflict should have overwritten but got %s, %v", target, err)
+	}
+
+	if _, err := resolveConflict(existing, int64(len(content)), matchingChecksum, ConflictOverwriteIfDifferent); err != FileExists {
+		t.Errorf("resolveConflict should have skipped an identical file but got %v", err)
+	}
+	if target, err := resolveConflict(existing, int64(len(content))+1, matchingChecksum, ConflictOverwriteIfDifferent); target != existing || err != nil {
+		t.Errorf("resolveConflict should have overwritten a file with a different size but got %s, %v", target, err)
+	}
+	otherSum := md5.Sum([]byte("some different content"))
+	if target, err := resolveConflict(existing, int64(len(content)), &expectedChecksum{Algorithm: "md5", Value: otherSum[:]}, ConflictOverwriteIfDifferent); target != existing || err != nil {
+		t.Errorf("resolveConflict should have overwritten a file with a different checksum but got %s, %v", target, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(tempDir, "clip (1).mov"), content, 0644)
+	expectedRename := filepath.Join(tempDir, "clip (2).mov")
+	if target, err := resolveConflict(existing, 10, nil, ConflictRename); target != expectedRename || err != nil {
+		t.Errorf("resolveConflict should have renamed to %s but got %s, %v", expectedRename, target, err)
+	}
+
+	//a partial download that could be this file is carried on with, one that can't is left alone
+	ioutil.WriteFile(partialPath(expectedRename), []byte("0123456789ab"), 0644)
+	if target, err := resolveConflict(existing, 10, nil, ConflictRename); target == expectedRename || err != nil {
+		t.Errorf("resolveConflict should not have used %s for a partial that is too big but got %s, %v", expectedRename, target, err)
+	}
+	if target, err := resolveConflict(existing, 20, nil, ConflictRename); target != expectedRename || err != nil {
+		t.Errorf("resolveConflict should have resumed the partial for %s but got %s, %v", expectedRename, target, err)
+	}
+	ioutil.WriteFile(segmentsPath(partialPath(expectedRename)), []byte(`{"fileSize":30,"segmentSize":10,"done":[true,false,false]}`), 0644)
+	if target, err := resolveConflict(existing, 20, nil, ConflictRename); target == expectedRename || err != nil {
+		t.Errorf("resolveConflict should not have used %s for a segmented partial of another size but got %s, %v", expectedRename, target, err)
+	}
+}
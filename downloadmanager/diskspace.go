@@ -0,0 +1,28 @@
+package downloadmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+//recorded against a file that could not be written because the download folder ran out of space
+var DiskFull = errors.New("disk full")
+
+/**
+returns the number of bytes available on the filesystem that will hold the given path. The path does not have to exist
+yet, in which case the nearest parent that does is checked
+*/
+func FreeSpaceFor(path string) (uint64, error) {
+	current := filepath.Clean(path)
+	for {
+		if _, statErr := os.Stat(current); statErr == nil {
+			return FreeSpace(current)
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return FreeSpace(current)
+		}
+		current = parent
+	}
+}
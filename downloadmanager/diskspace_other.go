@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package downloadmanager
+
+import (
+	"errors"
+	"syscall"
+)
+
+/**
+returns the number of bytes available to us on the filesystem holding the given path
+*/
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+/**
+returns true if the error means that the disk is full
+*/
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+package downloadmanager
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	errorHandleDiskFull syscall.Errno = 39
+	errorDiskFull       syscall.Errno = 112
+)
+
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+/**
+returns the number of bytes available to us on the volume holding the given path
+*/
+func FreeSpace(path string) (uint64, error) {
+	pathPtr, pathErr := syscall.UTF16PtrFromString(path)
+	if pathErr != nil {
+		return 0, pathErr
+	}
+	var freeBytesAvailable uint64
+	result, _, callErr := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&freeBytesAvailable)), 0, 0)
+	if result == 0 {
+		return 0, callErr
+	}
+	return freeBytesAvailable, nil
+}
+
+/**
+returns true if the error means that the disk is full
+*/
+func isDiskFull(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull)
+}
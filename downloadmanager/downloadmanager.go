@@ -1,9 +1,12 @@
 package downloadmanager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/guardian/autopull/communicator"
+	"github.com/guardian/autopull/state"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -12,131 +15,373 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type DownloadManager interface {
-	Init() error
-	Shutdown(wait bool)
-	DownloadThread()
-	PerformDownload(incomingEntry *communicator.ArchiveEntryDownloadSynopsis, linkInfo *communicator.DownloadManagerItemResponse) error
+	Init(ctx context.Context) error
+	CompleteAndWait() []*DownloadResult
+	Stop()
+	DownloadThread(ctx context.Context, workerId int)
+	PerformDownload(ctx context.Context, workerId int, incomingEntry *communicator.ArchiveEntryDownloadSynopsis, linkInfo *communicator.DownloadManagerItemResponse) error
 	Enqueue(incomingEntry communicator.ArchiveEntryDownloadSynopsis)
+	SpaceNeeded(entries []communicator.ArchiveEntryDownloadSynopsis) int64
+	Plan(ctx context.Context, entries []communicator.ArchiveEntryDownloadSynopsis) []*EntryPlan
+}
+
+type Options struct {
+	ThreadCount            int
+	BufferSize             int
+	BasePath               string
+	ConflictPolicy         ConflictPolicy             //what to do when there is already a file where we want to download to
+	RestorePollInterval    time.Duration              //how long to wait before checking again on an item that is still restoring
+	RestorePollMaxInterval time.Duration              //the poll interval doubles each time up to this limit
+	RestoreMaxWait         time.Duration              //how long to wait for a restore before giving up. Zero means don't wait at all.
+	RestoreTier            communicator.RetrievalTier //retrieval tier to request restores with. Empty means don't request restores.
+	RestoreCheckInterval   time.Duration              //how often to look for restoring items that are due to be polled. Zero means once a second.
+	Progress               *ProgressTracker           //optional, updated as downloads progress
+	PathMapping            PathMapping                //how to rewrite names that the local filesystem can't take
+	State                  *state.Store               //optional, records completed entries so that they are not downloaded again
+	SegmentThreshold       int64                      //files at least this big are downloaded in segments over several connections. Zero means never.
+	SegmentSize            int64                      //size of each segment
+	SegmentStreams         int                        //how many segments of a file to download at once
+	Bandwidth              *BandwidthLimiter          //optional, shared limit on the total download rate
 }
 
 //NOTE: anything in here must be threadsafe, and is considered immutable for that reason
 type DownloadManagerImpl struct {
-	DownloadThreadCount int
-	LongLivedToken      string
-	Communicator        *communicator.Communicator
-	incomingChannel     chan communicator.ArchiveEntryDownloadSynopsis
-	errorChannel        chan error
-	BasePath            string
-	CanClobber          bool
-	waitGroup           *sync.WaitGroup
+	DownloadThreadCount    int
+	LongLivedToken         string
+	Communicator           *communicator.Communicator
+	incomingChannel        chan communicator.ArchiveEntryDownloadSynopsis
+	BasePath               string
+	ConflictPolicy         ConflictPolicy
+	RestorePollInterval    time.Duration
+	RestorePollMaxInterval time.Duration
+	RestoreMaxWait         time.Duration
+	RestoreTier            communicator.RetrievalTier
+	RestoreCheckInterval   time.Duration
+	Progress               *ProgressTracker
+	PathMapping            PathMapping
+	State                  *state.Store
+	SegmentThreshold       int64
+	SegmentSize            int64
+	SegmentStreams         int
+	Bandwidth              *BandwidthLimiter
+	waitGroup              *sync.WaitGroup
+	outstanding            *sync.WaitGroup //counts items that have been enqueued but not yet finished with, including deferred ones
+	restoreWatcher         *restoreWatcher
+	restoreRequested       map[string]bool //entry ids that we have already asked to be restored
+	restoreRequestedMutex  sync.Mutex
+	results                []*DownloadResult
+	resultsMutex           sync.Mutex
+	stopChan               chan struct{} //closed when we should stop taking new items
+	stopOnce               sync.Once
 }
 
-func NewDownloadManager(comm *communicator.Communicator, longLivedToken string, threadCount int, bufferSize int, basePath string, canClobber bool) DownloadManager {
+func NewDownloadManager(comm *communicator.Communicator, longLivedToken string, opts Options) DownloadManager {
 	var properBasePath string
-	if strings.HasSuffix(basePath, "/") {
+	if strings.HasSuffix(opts.BasePath, "/") {
 		r := regexp.MustCompile("/+$")
-		properBasePath = r.ReplaceAllString(basePath, "")
+		properBasePath = r.ReplaceAllString(opts.BasePath, "")
 	} else {
-		properBasePath = basePath
+		properBasePath = opts.BasePath
 	}
 	return &DownloadManagerImpl{
-		DownloadThreadCount: threadCount,
-		LongLivedToken:      longLivedToken,
-		Communicator:        comm,
-		incomingChannel:     make(chan communicator.ArchiveEntryDownloadSynopsis, bufferSize),
-		errorChannel:        make(chan error, bufferSize),
-		BasePath:            properBasePath,
-		CanClobber:          canClobber,
-		waitGroup:           &sync.WaitGroup{},
+		DownloadThreadCount:    opts.ThreadCount,
+		LongLivedToken:         longLivedToken,
+		Communicator:           comm,
+		incomingChannel:        make(chan communicator.ArchiveEntryDownloadSynopsis, opts.BufferSize),
+		BasePath:               properBasePath,
+		ConflictPolicy:         opts.ConflictPolicy,
+		RestorePollInterval:    opts.RestorePollInterval,
+		RestorePollMaxInterval: opts.RestorePollMaxInterval,
+		RestoreMaxWait:         opts.RestoreMaxWait,
+		RestoreTier:            opts.RestoreTier,
+		RestoreCheckInterval:   opts.RestoreCheckInterval,
+		Progress:               opts.Progress,
+		PathMapping:            opts.PathMapping,
+		State:                  opts.State,
+		SegmentThreshold:       opts.SegmentThreshold,
+		SegmentSize:            opts.SegmentSize,
+		SegmentStreams:         opts.SegmentStreams,
+		Bandwidth:              opts.Bandwidth,
+		restoreRequested:       make(map[string]bool),
+		results:                make([]*DownloadResult, 0),
+		waitGroup:              &sync.WaitGroup{},
+		outstanding:            &sync.WaitGroup{},
+		stopChan:               make(chan struct{}),
 	}
 }
 
-func (d *DownloadManagerImpl) Init() error {
+/**
+starts up the download threads. Cancelling the given context aborts everything immediately, leaving any partial
+downloads in place to be resumed; use Stop() to finish off gracefully.
+*/
+func (d *DownloadManagerImpl) Init(ctx context.Context) error {
 	log.Printf("DEBUG DownloadManager.Init initialising %d download routines", d.DownloadThreadCount)
+	d.waitGroup.Add(d.DownloadThreadCount)
 	for i := 0; i < d.DownloadThreadCount; i += 1 {
-		go d.DownloadThread()
+		go d.DownloadThread(ctx, i)
+	}
+	if d.RestoreMaxWait > 0 {
+		d.restoreWatcher = newRestoreWatcher(d)
+		go d.restoreWatcher.Run(ctx)
 	}
 	return nil
 }
 
-func (d *DownloadManagerImpl) Shutdown(wait bool) {
-	for i := 0; i < d.DownloadThreadCount; i += 1 {
-		d.incomingChannel <- communicator.ArchiveEntryDownloadSynopsis{}
+/**
+stops taking new items. Downloads that are already in progress are allowed to finish, and everything else (including
+items that are waiting for a restore) is marked as cancelled.
+*/
+func (d *DownloadManagerImpl) Stop() {
+	d.stopOnce.Do(func() {
+		log.Printf("INFO DownloadManager.Stop not starting any more downloads")
+		close(d.stopChan)
+	})
+}
+
+func (d *DownloadManagerImpl) isStopping() bool {
+	select {
+	case <-d.stopChan:
+		return true
+	default:
+		return false
 	}
-	if wait {
-		d.waitGroup.Wait()
+}
+
+/**
+call this once everything has been enqueued. It waits for every item (including items that are waiting for a restore)
+to be finished with, shuts down the download threads and returns the result for each item.
+Enqueue must not be called after this.
+*/
+func (d *DownloadManagerImpl) CompleteAndWait() []*DownloadResult {
+	d.outstanding.Wait()
+	if d.restoreWatcher != nil {
+		d.restoreWatcher.Stop()
 	}
+	close(d.incomingChannel)
+	d.waitGroup.Wait()
+
+	d.resultsMutex.Lock()
+	defer d.resultsMutex.Unlock()
+	return d.results
 }
 
 func (d *DownloadManagerImpl) Enqueue(incomingEntry communicator.ArchiveEntryDownloadSynopsis) {
+	d.outstanding.Add(1)
+	if d.isStopping() {
+		d.itemCompleted(&incomingEntry, StatusCancelled, RunStopped, time.Now())
+		return
+	}
 	d.incomingChannel <- incomingEntry
 }
 
-func (d *DownloadManagerImpl) DownloadThread() {
-	log.Print("DEBUG DownloadManager.DownloadThread initialising")
-	d.waitGroup.Add(1)
-	for {
-		select {
-		case incomingEntry := <-d.incomingChannel:
-			if incomingEntry.EntryId == "" {
-				log.Printf("INFO DownloadManager.DownloadThread terminating")
-				d.waitGroup.Done()
-				return
-			}
-			log.Printf("INFO DownloadManager.DownloadThread getting download link for %s", incomingEntry.EntryId)
-			linkInfoPtr, linkInfoErr := d.Communicator.GetItemLink(d.LongLivedToken, incomingEntry.EntryId, 0)
-			if linkInfoErr != nil {
-				if linkInfoErr != nil {
-					log.Printf("ERROR DownloadManager.DownloadThread could not get download link: %s", linkInfoErr)
-					continue
-				}
-			}
+func newResult(entry *communicator.ArchiveEntryDownloadSynopsis, status ResultStatus, err error, startTime time.Time) *DownloadResult {
+	result := &DownloadResult{
+		Entry:    *entry,
+		Status:   status,
+		Error:    err,
+		Duration: time.Since(startTime),
+	}
+	if status == StatusDownloaded {
+		result.Bytes = entry.FileSize
+	}
+	return result
+}
 
-			switch linkInfoPtr.RestoreStatus {
-			case "RS_PENDING":
-				fallthrough
-			case "RS_UNDERWAY":
-				fallthrough
-			case "RS_ERROR":
-				log.Printf("ERROR DownloadManager.DownloadThread %s is not available to download, restore status is %s", incomingEntry.Path, linkInfoPtr.RestoreStatus)
-			case "RS_UNNEEDED":
-				fallthrough
-			case "RS_ALREADY":
-				fallthrough
-			case "RS_SUCCESS":
-				log.Printf("INFO DownloadManager.DownloadThread %s is available to download", incomingEntry.Path)
-				dlErr := d.PerformDownload(&incomingEntry, linkInfoPtr)
-				if dlErr != nil {
-					log.Printf("ERROR DownloadManager.DownloadThread could not download content for %s: %s", incomingEntry.Path, dlErr)
-				}
-			}
+/**
+marks an enqueued item as finished with, recording the outcome
+*/
+func (d *DownloadManagerImpl) recordResult(result *DownloadResult) {
+	if localPath, pathErr := d.localPathFor(&result.Entry); pathErr == nil {
+		if result.LocalPath == "" {
+			result.LocalPath = localPath
 		}
+		result.Renamed = MapPath(result.Entry.Path, d.PathMapping) != result.Entry.Path
+		result.ConflictRenamed = result.LocalPath != localPath
 	}
+	d.Progress.ItemCompleted(result.Entry.FileSize, result.Status == StatusDownloaded)
+	d.resultsMutex.Lock()
+	d.results = append(d.results, result)
+	d.resultsMutex.Unlock()
+	d.outstanding.Done()
+}
+
+func (d *DownloadManagerImpl) itemCompleted(entry *communicator.ArchiveEntryDownloadSynopsis, status ResultStatus, err error, startTime time.Time) {
+	d.recordResult(newResult(entry, status, err, startTime))
 }
 
-func verifyFile(pathTarget string, canClobber bool) error {
-	_, statErr := os.Stat(pathTarget)
-	if statErr == nil {
-		log.Printf("WARN DownloadManager.PerformDownload a file already exists at %s", pathTarget)
-		if !canClobber {
-			log.Printf("WARN DownloadManager.PerformDownload not overwriting an existing file. If you want to overwrite, specify this in the config")
-			return errors.New("file already exists")
+/**
+asks the server to restore the given entry, if we are configured to and have not already done so.
+returns true if a restore was requested
+*/
+func (d *DownloadManagerImpl) requestRestore(ctx context.Context, entry *communicator.ArchiveEntryDownloadSynopsis) bool {
+	if d.RestoreTier == "" {
+		return false
+	}
+	if d.Communicator.Type != communicator.ArchiveHunter {
+		//only ArchiveHunter can restore items, VaultDoor tokens are not valid there
+		log.Printf("WARN DownloadManager.requestRestore can't request a restore of %s, restores can only be requested for ArchiveHunter downloads", entry.Path)
+		return false
+	}
+
+	d.restoreRequestedMutex.Lock()
+	alreadyRequested := d.restoreRequested[entry.EntryId]
+	d.restoreRequested[entry.EntryId] = true
+	d.restoreRequestedMutex.Unlock()
+	if alreadyRequested {
+		log.Printf("ERROR DownloadManager.requestRestore restore of %s has already been requested and did not succeed", entry.Path)
+		return false
+	}
+
+	log.Printf("INFO DownloadManager.requestRestore requesting %s restore of %s", d.RestoreTier, entry.Path)
+	err := d.Communicator.RequestRestore(ctx, d.LongLivedToken, entry.EntryId, d.RestoreTier)
+	if err != nil {
+		log.Printf("ERROR DownloadManager.requestRestore could not request restore of %s: %s", entry.Path, err)
+		if errors.Is(err, communicator.ErrTokenInvalid) {
+			d.Stop()
 		}
-	} else {
-		if !os.IsNotExist(statErr) {
-			log.Printf("ERROR DownloadManager.PerformDownload could not check for existence of file: %s", statErr)
-			return statErr
+		return false
+	}
+	return true
+}
+
+func (d *DownloadManagerImpl) DownloadThread(ctx context.Context, workerId int) {
+	log.Printf("DEBUG DownloadManager.DownloadThread %d initialising", workerId)
+	defer d.waitGroup.Done()
+	for incomingEntry := range d.incomingChannel {
+		if d.isStopping() {
+			d.itemCompleted(&incomingEntry, StatusCancelled, RunStopped, time.Now())
+		} else {
+			d.processEntry(ctx, workerId, incomingEntry)
 		}
 	}
-	return nil
+	log.Printf("INFO DownloadManager.DownloadThread terminating")
+}
+
+func (d *DownloadManagerImpl) processEntry(ctx context.Context, workerId int, incomingEntry communicator.ArchiveEntryDownloadSynopsis) {
+	startTime := time.Now()
+
+	//don't bother the server about anything that we would refuse to write
+	if _, pathErr := d.localPathFor(&incomingEntry); pathErr != nil {
+		log.Printf("ERROR DownloadManager.DownloadThread SECURITY refusing to download %s: %s", incomingEntry.Path, pathErr)
+		d.itemCompleted(&incomingEntry, StatusUnsafePath, pathErr, startTime)
+		return
+	}
+
+	if d.State != nil {
+		if completed := d.State.CompletedEntry(d.LongLivedToken, &incomingEntry); completed != nil {
+			log.Printf("INFO DownloadManager.DownloadThread %s was already downloaded to %s at %s", incomingEntry.Path, completed.LocalPath, completed.CompletedAt.Format(time.RFC3339))
+			result := newResult(&incomingEntry, StatusSkippedExists, nil, startTime)
+			result.LocalPath = completed.LocalPath
+			result.Checksum = completed.Checksum
+			d.recordResult(result)
+			return
+		}
+	}
+
+	log.Printf("INFO DownloadManager.DownloadThread getting download link for %s", incomingEntry.EntryId)
+	linkInfoPtr, linkInfoErr := d.Communicator.GetItemLink(ctx, d.LongLivedToken, incomingEntry.EntryId)
+	if ctx.Err() != nil {
+		d.itemCompleted(&incomingEntry, StatusCancelled, RunStopped, startTime)
+		return
+	}
+	if linkInfoErr != nil {
+		log.Printf("ERROR DownloadManager.DownloadThread could not get download link: %s", linkInfoErr)
+		d.itemCompleted(&incomingEntry, StatusFailed, fmt.Errorf("could not get download link: %w", linkInfoErr), startTime)
+		if errors.Is(linkInfoErr, communicator.ErrTokenInvalid) {
+			//nothing else is going to work either
+			log.Printf("ERROR DownloadManager.DownloadThread the server no longer accepts the download token, stopping")
+			d.Stop()
+		}
+		return
+	}
+
+	switch linkInfoPtr.RestoreStatus {
+	case "RS_PENDING":
+		fallthrough
+	case "RS_UNDERWAY":
+		if d.restoreWatcher != nil {
+			log.Printf("INFO DownloadManager.DownloadThread %s is still being restored (%s), will check again later", incomingEntry.Path, linkInfoPtr.RestoreStatus)
+			d.restoreWatcher.Add(incomingEntry)
+		} else {
+			log.Printf("ERROR DownloadManager.DownloadThread %s is not available to download, restore status is %s", incomingEntry.Path, linkInfoPtr.RestoreStatus)
+			d.itemCompleted(&incomingEntry, StatusNotRestored, linkInfoPtr.NotRestoredError(), startTime)
+		}
+	case "RS_ERROR":
+		fallthrough
+	case "RS_EXPIRED":
+		if !d.requestRestore(ctx, &incomingEntry) {
+			log.Printf("ERROR DownloadManager.DownloadThread %s is not available to download, restore status is %s", incomingEntry.Path, linkInfoPtr.RestoreStatus)
+			d.itemCompleted(&incomingEntry, StatusNotRestored, linkInfoPtr.NotRestoredError(), startTime)
+		} else if d.restoreWatcher != nil {
+			d.restoreWatcher.Add(incomingEntry)
+		} else {
+			log.Printf("WARN DownloadManager.DownloadThread a restore has been requested for %s but we are not waiting for restores. Try again later.", incomingEntry.Path)
+			d.itemCompleted(&incomingEntry, StatusNotRestored, fmt.Errorf("restore requested, not yet available: %w", linkInfoPtr.NotRestoredError()), startTime)
+		}
+	case "RS_UNNEEDED":
+		fallthrough
+	case "RS_ALREADY":
+		fallthrough
+	case "RS_SUCCESS":
+		log.Printf("INFO DownloadManager.DownloadThread %s is available to download", incomingEntry.Path)
+		localPath, dlErr := d.performDownload(ctx, workerId, &incomingEntry, linkInfoPtr)
+		if ctx.Err() != nil {
+			log.Printf("WARN DownloadManager.DownloadThread download of %s was interrupted", incomingEntry.Path)
+			d.itemCompleted(&incomingEntry, StatusCancelled, errors.New("interrupted, partial download kept for resuming"), startTime)
+		} else if errors.Is(dlErr, UnsafePath) {
+			d.itemCompleted(&incomingEntry, StatusUnsafePath, dlErr, startTime)
+		} else if dlErr == FileExists {
+			d.itemCompleted(&incomingEntry, StatusSkippedExists, nil, startTime)
+		} else if dlErr == FileConflict {
+			d.itemCompleted(&incomingEntry, StatusFailed, dlErr, startTime)
+			d.Stop()
+		} else if isDiskFull(dlErr) {
+			log.Printf("ERROR DownloadManager.DownloadThread the download folder is full, stopping. %s: %s", incomingEntry.Path, dlErr)
+			d.itemCompleted(&incomingEntry, StatusFailed, DiskFull, startTime)
+			d.Stop()
+		} else if dlErr != nil {
+			log.Printf("ERROR DownloadManager.DownloadThread could not download content for %s: %s", incomingEntry.Path, dlErr)
+			d.itemCompleted(&incomingEntry, StatusFailed, dlErr, startTime)
+		} else {
+			result := newResult(&incomingEntry, StatusDownloaded, nil, startTime)
+			result.LocalPath = localPath
+			if checksum := pickChecksum(&incomingEntry, linkInfoPtr); checksum != nil {
+				result.Checksum = checksum.String()
+			}
+			if d.State != nil {
+				if stateErr := d.State.MarkCompleted(d.LongLivedToken, &incomingEntry, localPath, result.Checksum); stateErr != nil {
+					log.Printf("WARN DownloadManager.DownloadThread could not record completion of %s in %s: %s", incomingEntry.Path, d.State.Path(), stateErr)
+				}
+			}
+			d.recordResult(result)
+		}
+	default:
+		log.Printf("ERROR DownloadManager.DownloadThread %s has an unrecognised restore status %s", incomingEntry.Path, linkInfoPtr.RestoreStatus)
+		d.itemCompleted(&incomingEntry, StatusFailed, fmt.Errorf("unrecognised restore status %s", linkInfoPtr.RestoreStatus), startTime)
+	}
 }
 
+/**
+returns how long the server asked us to wait before trying again, if it did
+*/
+func retryAfterFor(err error) time.Duration {
+	var retryable *communicator.RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.RetryAfter
+	}
+	return 0
+}
+
+//reason given for items that were never attempted because the run was stopped
+var RunStopped = errors.New("run was stopped before this was downloaded")
+
 func prepareDirectories(pathTarget string) error {
 	dirname := filepath.Dir(pathTarget)
 	if len(dirname) == 0 {
@@ -155,36 +400,160 @@ func prepareDirectories(pathTarget string) error {
 	}
 }
 
-func doDownload(pathTarget string, downloadUrl string, expectedSize int64) (bool, error) {
-	file, openErr := os.OpenFile(pathTarget, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+/**
+parses the start offset out of a Content-Range header of the form "bytes 100-199/200"
+*/
+func parseContentRangeStart(header string) (int64, error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, fmt.Errorf("unsupported content range '%s'", header)
+	}
+	spec := strings.TrimPrefix(header, "bytes ")
+	dashPos := strings.Index(spec, "-")
+	if dashPos < 0 {
+		return 0, fmt.Errorf("unsupported content range '%s'", header)
+	}
+	return strconv.ParseInt(spec[:dashPos], 10, 64)
+}
+
+/**
+downloads the given url to pathTarget, which should be the partial download file. If `resume` is true then any data already in the file is kept and we ask the
+server for the remainder with a Range request; if the server ignores that then we fall back to downloading the whole
+thing again.
+`progress` is optional and is kept updated with how much of the file we have, and `limiter` is optional and keeps
+the download under the bandwidth limit.
+If `checksum` is not nil then the content is hashed as it is written and checked against it once the download is
+complete. A mismatch is treated as a retryable failure, and the partial is discarded.
+returns a boolean indicating whether the operation should be retried and an error if it failed
+*/
+func doDownload(ctx context.Context, client *http.Client, pathTarget string, downloadUrl string, expectedSize int64, resume bool, checksum *expectedChecksum, progress *FileProgress, limiter *BandwidthLimiter) (bool, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	file, openErr := os.OpenFile(pathTarget, flags, 0644)
 	if openErr != nil {
 		log.Printf("ERROR DownloadManager.PerformDownload could not open target file %s: %s", pathTarget, openErr)
 		return false, openErr
 	}
 	defer file.Close()
 
-	dlResponse, dlErr := http.Get(downloadUrl)
+	startOffset, seekErr := file.Seek(0, io.SeekEnd)
+	if seekErr != nil {
+		log.Printf("ERROR DownloadManager.PerformDownload could not seek to end of %s: %s", pathTarget, seekErr)
+		return false, seekErr
+	}
+
+	req, reqErr := http.NewRequestWithContext(ctx, "GET", downloadUrl, nil)
+	if reqErr != nil {
+		log.Printf("ERROR DownloadManager.PerformDownload could not build request for %s: %s", downloadUrl, reqErr)
+		return false, reqErr
+	}
+	if startOffset > 0 {
+		log.Printf("INFO DownloadManager.PerformDownload resuming %s from byte %d", pathTarget, startOffset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startOffset))
+	}
+
+	dlResponse, dlErr := client.Do(req)
 	if dlErr != nil {
 		log.Printf("ERROR DownloadManager.PerformDownload could not initiate download: %s", dlErr)
-		return true, dlErr
+		return communicator.IsRetryableError(dlErr), dlErr
 	}
 	defer dlResponse.Body.Close()
+	if retryErr := communicator.RetryableResponse(dlResponse); retryErr != nil {
+		return true, retryErr
+	}
+
+	//make sure that everything is on disk before we report success, so that the file can safely be moved into place
+	syncAndReturn := func(shouldRetry bool, err error) (bool, error) {
+		if err == nil {
+			if syncErr := file.Sync(); syncErr != nil {
+				log.Printf("ERROR DownloadManager.PerformDownload could not flush %s to disk: %s", pathTarget, syncErr)
+				return true, syncErr
+			}
+		}
+		return shouldRetry, err
+	}
 
 	switch dlResponse.StatusCode {
+	case 206:
+		rangeStart, rangeErr := parseContentRangeStart(dlResponse.Header.Get("Content-Range"))
+		if rangeErr != nil || rangeStart != startOffset {
+			log.Printf("WARN DownloadManager.PerformDownload server sent an unexpected range '%s' for %s, restarting from zero", dlResponse.Header.Get("Content-Range"), pathTarget)
+			file.Truncate(0)
+			return true, errors.New("server returned the wrong byte range")
+		}
+		fallthrough
 	case 200:
+		if dlResponse.StatusCode == 200 && startOffset > 0 {
+			log.Printf("INFO DownloadManager.PerformDownload server does not support resuming %s, restarting from zero", pathTarget)
+			if truncErr := file.Truncate(0); truncErr != nil {
+				log.Printf("ERROR DownloadManager.PerformDownload could not truncate %s: %s", pathTarget, truncErr)
+				return false, truncErr
+			}
+			if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+				log.Printf("ERROR DownloadManager.PerformDownload could not seek in %s: %s", pathTarget, seekErr)
+				return false, seekErr
+			}
+			startOffset = 0
+		}
+		var writer io.Writer = file
+		var hasher hash.Hash
+		if checksum != nil {
+			hasher = checksum.newHash()
+			if startOffset > 0 {
+				if hashErr := hashExistingContent(hasher, pathTarget, startOffset); hashErr != nil {
+					log.Printf("ERROR DownloadManager.PerformDownload could not read back existing data in %s: %s", pathTarget, hashErr)
+					return false, hashErr
+				}
+			}
+			writer = io.MultiWriter(file, hasher)
+		}
 		//log.Printf("INFO DownloadManager.PerformDownload downloading %s to %s", downloadUrl, pathTarget)
-		bytesCopied, copyErr := io.Copy(file, dlResponse.Body)
+		progress.Set(startOffset)
+		bytesCopied, copyErr := io.Copy(writer, limiter.WrapReader(ctx, progress.WrapReader(dlResponse.Body)))
 		if copyErr != nil {
-			log.Printf("ERROR DownloadManager.PerformDownload download of %s failed: %s", pathTarget, copyErr)
-			os.Remove(pathTarget)
-			return false, copyErr
+			//keep what we have got so far, the next attempt will pick up from there
+			log.Printf("ERROR DownloadManager.PerformDownload download of %s failed after %d bytes: %s", pathTarget, startOffset+bytesCopied, copyErr)
+			return true, copyErr
+		}
+		totalBytes := startOffset + bytesCopied
+		if totalBytes < expectedSize {
+			//keep what we have got, the next attempt will resume from there
+			log.Printf("ERROR DownloadManager.PerformDownload %s short download, expected %d got %d", pathTarget, expectedSize, totalBytes)
+			return true, ShortDownload
+		} else if totalBytes > expectedSize {
+			log.Printf("ERROR DownloadManager.PerformDownload %s downloaded more bytes than expected, expected %d got %d. Discarding it.", pathTarget, expectedSize, totalBytes)
+			file.Truncate(0)
+			return true, OversizedDownload
+		}
+		if hasher != nil && !checksum.matches(hasher) {
+			log.Printf("ERROR DownloadManager.PerformDownload %s failed checksum verification, expected %s got %x. Discarding it.", pathTarget, checksum, hasher.Sum(nil))
+			file.Truncate(0)
+			return true, ChecksumMismatch
 		}
-		if bytesCopied < expectedSize {
-			log.Printf("WARN DownloadManager.PerformDownload %s potential short download, expected %d got %d", pathTarget, expectedSize, bytesCopied)
-		} else if bytesCopied > expectedSize {
-			log.Printf("WARN DownloadManager.PerformDownload %s downloaded more bytes than expected??? Strange. Expected %d got %d", pathTarget, expectedSize, bytesCopied)
+		return syncAndReturn(false, nil)
+	case 416:
+		//we asked for a range starting beyond the end of the content
+		if startOffset == expectedSize {
+			if checksum != nil {
+				hasher := checksum.newHash()
+				if hashErr := hashExistingContent(hasher, pathTarget, startOffset); hashErr != nil {
+					return false, hashErr
+				}
+				if !checksum.matches(hasher) {
+					log.Printf("ERROR DownloadManager.PerformDownload existing data for %s failed checksum verification, discarding it", pathTarget)
+					file.Truncate(0)
+					return true, ChecksumMismatch
+				}
+			}
+			log.Printf("INFO DownloadManager.PerformDownload %s was already fully downloaded", pathTarget)
+			return syncAndReturn(false, nil)
+		}
+		log.Printf("WARN DownloadManager.PerformDownload existing data for %s is larger than the server copy, restarting from zero", pathTarget)
+		if truncErr := file.Truncate(0); truncErr != nil {
+			return false, truncErr
 		}
-		return false, nil
+		return true, errors.New("partial download was not valid")
 	case 404:
 		errorContent, _ := ioutil.ReadAll(dlResponse.Body)
 		log.Printf("ERROR DownloadManager.PerformDownload %s was not found. Server said %s", downloadUrl, string(errorContent))
@@ -192,14 +561,10 @@ func doDownload(pathTarget string, downloadUrl string, expectedSize int64) (bool
 	case 403:
 		log.Printf("ERROR DownloadManager.PerformDownload server responded permission denied, maybe token expired? Try re-starting the download from your browser")
 		return false, errors.New("server permission denied")
-	case 502:
-		fallthrough
-	case 503:
-		fallthrough
-	case 504:
-		return true, errors.New("server was not available")
 	default:
-		os.Remove(pathTarget)
+		if startOffset == 0 {
+			os.Remove(pathTarget)
+		}
 		errorContent, _ := ioutil.ReadAll(dlResponse.Body)
 		log.Printf("ERROR DownloadManager.PerformDownload server responded %d: %s", dlResponse.StatusCode, string(errorContent))
 		return false, errors.New("server error")
@@ -220,10 +585,33 @@ func makeAbsoluteUrl(baseUri url.URL, tailUri url.URL) (url.URL, error) {
 	return rtn, nil
 }
 
-func (d *DownloadManagerImpl) PerformDownload(incomingEntry *communicator.ArchiveEntryDownloadSynopsis, linkInfo *communicator.DownloadManagerItemResponse) error {
-	pathTarget := filepath.Join(d.BasePath, incomingEntry.Path)
+/**
+works out where the given entry should be written, applying the path mapping and making sure it stays inside the
+download folder
+*/
+func (d *DownloadManagerImpl) localPathFor(entry *communicator.ArchiveEntryDownloadSynopsis) (string, error) {
+	return confinePath(d.BasePath, MapPath(entry.Path, d.PathMapping))
+}
+
+func (d *DownloadManagerImpl) PerformDownload(ctx context.Context, workerId int, incomingEntry *communicator.ArchiveEntryDownloadSynopsis, linkInfo *communicator.DownloadManagerItemResponse) error {
+	_, err := d.performDownload(ctx, workerId, incomingEntry, linkInfo)
+	return err
+}
+
+/**
+downloads the given entry, returning the path that it was written to
+*/
+func (d *DownloadManagerImpl) performDownload(ctx context.Context, workerId int, incomingEntry *communicator.ArchiveEntryDownloadSynopsis, linkInfo *communicator.DownloadManagerItemResponse) (string, error) {
+	pathTarget, pathErr := d.localPathFor(incomingEntry)
+	if pathErr != nil {
+		log.Printf("ERROR DownloadManager.PerformDownload refusing to download %s: %s", incomingEntry.Path, pathErr)
+		return "", pathErr
+	}
 
 	log.Printf("DEBUG DownloadManager.PerformDownload pathTarget is %s, linkInfo is %v", pathTarget, linkInfo)
+	if mappedPath := MapPath(incomingEntry.Path, d.PathMapping); mappedPath != incomingEntry.Path {
+		log.Printf("INFO DownloadManager.PerformDownload %s can't be used as a local filename, saving it as %s", incomingEntry.Path, mappedPath)
+	}
 
 	//downloadUri, _ := makeAbsoluteUrl(d.Communicator.VaultDoorUri, linkInfo.DownloadLink)
 	var downloadUri url.URL
@@ -233,38 +621,102 @@ func (d *DownloadManagerImpl) PerformDownload(incomingEntry *communicator.Archiv
 		downloadUri = linkInfo.DownloadLink
 	}
 
-	//verify if a file already exists
-	verifyErr := verifyFile(pathTarget, d.CanClobber)
-	if verifyErr != nil {
-		return verifyErr
+	checksum := pickChecksum(incomingEntry, linkInfo)
+	if checksum == nil {
+		log.Printf("WARN DownloadManager.PerformDownload server did not provide a usable checksum for %s, only the file size will be verified", incomingEntry.Path)
+	}
+
+	//check what to do if a file already exists
+	resolvedTarget, conflictErr := resolveConflict(pathTarget, incomingEntry.FileSize, checksum, d.ConflictPolicy)
+	if conflictErr != nil {
+		removeStalePartial(partialPath(pathTarget))
+		return "", conflictErr
 	}
+	pathTarget = resolvedTarget
+	partialTarget := partialPath(pathTarget)
 
 	//create directories if necessary
 	dirErr := prepareDirectories(pathTarget)
 	if dirErr != nil {
-		return dirErr
+		return "", dirErr
+	}
+
+	segmented := d.isSegmented(incomingEntry)
+	resume := false
+	if !segmented {
+		if _, statErr := os.Stat(segmentsPath(partialTarget)); statErr == nil {
+			//a segmented download can have holes in it, so it can't be resumed as a single stream
+			log.Printf("INFO DownloadManager.PerformDownload discarding segmented partial download %s", partialTarget)
+			removeSegmented(partialTarget)
+		}
+		//pick up from any partial download left over from a previous run
+		var partialErr error
+		resume, partialErr = checkPartial(partialTarget, incomingEntry.FileSize)
+		if partialErr != nil {
+			return "", partialErr
+		}
 	}
 
+	fileProgress := d.Progress.StartFile(workerId, incomingEntry.Path, incomingEntry.FileSize)
+	defer d.Progress.FinishFile(workerId)
+
 	//perform download, retrying on recoverable errors
+	retryPolicy := d.Communicator.RetryPolicy()
 	attempts := 0
 	for {
-		shouldRetry, dlErr := doDownload(pathTarget, downloadUri.String(), incomingEntry.FileSize)
+		var shouldRetry bool
+		var dlErr error
+		if segmented {
+			shouldRetry, dlErr = doSegmentedDownload(ctx, d.Communicator.Client(), partialTarget, downloadUri.String(), incomingEntry.FileSize, d.SegmentSize, d.SegmentStreams, checksum, fileProgress, d.Bandwidth, retryPolicy)
+			if dlErr == RangesNotSupported {
+				segmented = false
+				continue
+			}
+		} else {
+			shouldRetry, dlErr = doDownload(ctx, d.Communicator.Client(), partialTarget, downloadUri.String(), incomingEntry.FileSize, resume, checksum, fileProgress, d.Bandwidth)
+			//anything written by a failed attempt is kept and resumed from on the next one
+			resume = true
+		}
 		if dlErr == nil {
-			log.Printf("INFO DownloadManager.PerformDownload completed download of %s", pathTarget)
 			break
+		} else if isDiskFull(dlErr) {
+			//no point retrying, the partial is kept to resume once there is space
+			return "", dlErr
+		} else if ctx.Err() != nil {
+			log.Printf("INFO DownloadManager.PerformDownload download of %s was cancelled, data received so far is kept in %s", pathTarget, partialTarget)
+			return "", ctx.Err()
 		} else {
 			if shouldRetry {
 				attempts += 1
-				if attempts >= 10 {
-					log.Printf("ERROR DownloadManager.PerformDownload giving up after %d attempts", attempts)
-					return errors.New(fmt.Sprintf("gave up after %d attempts", attempts))
+				if attempts >= retryPolicy.MaxAttempts {
+					log.Printf("ERROR DownloadManager.PerformDownload giving up on %s after %d attempts", pathTarget, attempts)
+					if isVerificationFailure(dlErr) {
+						log.Printf("ERROR DownloadManager.PerformDownload removing unverifiable download %s", partialTarget)
+						removeSegmented(partialTarget)
+					} else {
+						log.Printf("INFO DownloadManager.PerformDownload data received so far is kept in %s and will be resumed next time", partialTarget)
+					}
+					return "", fmt.Errorf("gave up after %d attempts: %s", attempts, dlErr)
+				}
+				delay := retryPolicy.Delay(attempts, retryAfterFor(dlErr))
+				log.Printf("WARN DownloadManager.PerformDownload %s, retrying in %s...", dlErr, delay.Round(time.Millisecond))
+				if sleepErr := communicator.SleepContext(ctx, delay); sleepErr != nil {
+					return "", sleepErr
 				}
-				log.Printf("WARN DownloadManager.PerformDownload %s, retrying after a delay...", dlErr)
-				time.Sleep(5 * time.Second)
 			} else {
-				break
+				return "", dlErr
 			}
 		}
 	}
-	return nil
+
+	finaliseErr := finaliseDownload(partialTarget, pathTarget, incomingEntry.FileSize)
+	if finaliseErr != nil {
+		return "", finaliseErr
+	}
+	if checksum != nil {
+		log.Printf("INFO DownloadManager.PerformDownload completed download of %s, verified %s", pathTarget, checksum)
+	} else {
+		log.Printf("INFO DownloadManager.PerformDownload completed download of %s", pathTarget)
+	}
+	return pathTarget, nil
 }
@@ -0,0 +1,382 @@
+package downloadmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDoDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var lastRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastRange = r.Header.Get("Range")
+		http.ServeContent(w, r, "testfile", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	pathTarget := filepath.Join(tempDir, "testfile")
+	ioutil.WriteFile(pathTarget, content[0:4000], 0644)
+
+	shouldRetry, err := doDownload(context.Background(), http.DefaultClient, pathTarget, server.URL, int64(len(content)), true, nil, nil, nil)
+	if err != nil {
+		t.Errorf("doDownload returned an error: %s (retry %t)", err, shouldRetry)
+	}
+	if lastRange != "bytes=4000-" {
+		t.Errorf("doDownload should have requested bytes=4000- but sent '%s'", lastRange)
+	}
+	written, _ := ioutil.ReadFile(pathTarget)
+	if !bytes.Equal(written, content) {
+		t.Errorf("resumed file did not match the server content, got %d bytes", len(written))
+	}
+}
+
+func TestDoDownloadRangeIgnored(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	pathTarget := filepath.Join(tempDir, "testfile")
+	ioutil.WriteFile(pathTarget, []byte("some old data"), 0644)
+
+	_, err := doDownload(context.Background(), http.DefaultClient, pathTarget, server.URL, int64(len(content)), true, nil, nil, nil)
+	if err != nil {
+		t.Errorf("doDownload returned an error: %s", err)
+	}
+	written, _ := ioutil.ReadFile(pathTarget)
+	if !bytes.Equal(written, content) {
+		t.Errorf("file should have been re-downloaded from zero, got %d bytes", len(written))
+	}
+}
+
+func TestParseContentRangeStart(t *testing.T) {
+	start, err := parseContentRangeStart("bytes 1024-2047/2048")
+	if err != nil || start != 1024 {
+		t.Errorf("parseContentRangeStart should have returned 1024 but got %d, %s", start, err)
+	}
+	_, err = parseContentRangeStart("pages 1-2/3")
+	if err == nil {
+		t.Errorf("parseContentRangeStart should have rejected a non-byte range")
+	}
+}
+
+func TestPerformDownloadUsesPartial(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "testfile", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	pathTarget := filepath.Join(tempDir, "subdir", "testfile")
+	os.MkdirAll(filepath.Dir(pathTarget), 0755)
+	ioutil.WriteFile(partialPath(pathTarget), content[0:2500], 0644)
+
+	linkUrl, _ := url.Parse(server.URL + "/testfile")
+	mgr := &DownloadManagerImpl{
+		Communicator: &communicator.Communicator{Type: communicator.ArchiveHunter},
+		BasePath:     tempDir,
+	}
+	entry := &communicator.ArchiveEntryDownloadSynopsis{EntryId: "abc", Path: "subdir/testfile", FileSize: int64(len(content))}
+	dlErr := mgr.PerformDownload(context.Background(), 0, entry, &communicator.DownloadManagerItemResponse{DownloadLink: *linkUrl})
+	if dlErr != nil {
+		t.Fatalf("PerformDownload returned an error: %s", dlErr)
+	}
+
+	written, _ := ioutil.ReadFile(pathTarget)
+	if !bytes.Equal(written, content) {
+		t.Errorf("downloaded file did not match the server content, got %d bytes", len(written))
+	}
+	if _, statErr := os.Stat(partialPath(pathTarget)); !os.IsNotExist(statErr) {
+		t.Errorf("partial download file should have been moved into place")
+	}
+}
+
+func TestDoDownloadChecksumMismatch(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "testfile", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	pathTarget := filepath.Join(tempDir, "testfile")
+
+	//resuming on top of corrupt data must be caught, since the corruption is in the bit we don't download again
+	corrupted := append([]byte{}, content[0:3000]...)
+	corrupted[100] = 'X'
+	ioutil.WriteFile(pathTarget, corrupted, 0644)
+
+	sum := md5.Sum(content)
+	checksum := &expectedChecksum{Algorithm: "md5", Value: sum[:]}
+	shouldRetry, err := doDownload(context.Background(), http.DefaultClient, pathTarget, server.URL, int64(len(content)), true, checksum, nil, nil)
+	if err != ChecksumMismatch || !shouldRetry {
+		t.Errorf("doDownload should have returned a retryable checksum mismatch but got %s (retry %t)", err, shouldRetry)
+	}
+
+	//the corrupt data should have been discarded so the retry gets a clean copy
+	shouldRetry, err = doDownload(context.Background(), http.DefaultClient, pathTarget, server.URL, int64(len(content)), true, checksum, nil, nil)
+	if err != nil {
+		t.Errorf("retried download should have succeeded but got %s", err)
+	}
+}
+
+func TestCompleteAndWait(t *testing.T) {
+	content := []byte("a short file")
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/bulk/") {
+			fmt.Fprintf(w, `{"status":"ok","restoreStatus":"RS_UNNEEDED","downloadLink":"%s/content"}`, server.URL)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+
+	serverUrl, _ := url.Parse(server.URL)
+	comm := &communicator.Communicator{ArchiveHunterUri: *serverUrl, Type: communicator.ArchiveHunter}
+	mgr := NewDownloadManager(comm, "sometoken", Options{ThreadCount: 3, BufferSize: 1, BasePath: tempDir})
+	mgr.Init(context.Background())
+	mgr.Enqueue(communicator.ArchiveEntryDownloadSynopsis{EntryId: "abc", Path: "file1", FileSize: int64(len(content))})
+	results := mgr.CompleteAndWait()
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result but got %d", len(results))
+	}
+	if results[0].Status != StatusDownloaded {
+		t.Errorf("expected the item to be downloaded but got %s: %s", results[0].Status, results[0].Error)
+	}
+}
+
+func TestDoSegmentedDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	var rangesMutex sync.Mutex
+	requestedRanges := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		requestedRanges[r.Header.Get("Range")] = true
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "testfile", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	partialTarget := filepath.Join(tempDir, "testfile"+PartialSuffix)
+
+	//pretend that a previous run got the second segment
+	ioutil.WriteFile(partialTarget, append(make([]byte, 4096), content[4096:8192]...), 0644)
+	previous := newSegmentState(int64(len(content)), 4096)
+	previous.Done[1] = true
+	previous.save(partialTarget)
+
+	sum := md5.Sum(content)
+	checksum := &expectedChecksum{Algorithm: "md5", Value: sum[:]}
+	shouldRetry, err := doSegmentedDownload(context.Background(), http.DefaultClient, partialTarget, server.URL, int64(len(content)), 4096, 3, checksum, nil, nil, communicator.DefaultRetryPolicy)
+	if err != nil {
+		t.Fatalf("doSegmentedDownload returned an error: %s (retry %t)", err, shouldRetry)
+	}
+	written, _ := ioutil.ReadFile(partialTarget)
+	if !bytes.Equal(written, content) {
+		t.Errorf("segmented download did not reassemble the content correctly")
+	}
+	if requestedRanges["bytes=4096-8191"] {
+		t.Errorf("segment that was already done should not have been requested again")
+	}
+	if !requestedRanges["bytes=0-4095"] || !requestedRanges["bytes=12288-15999"] {
+		t.Errorf("expected segments were not requested, got %v", requestedRanges)
+	}
+	if _, statErr := os.Stat(segmentsPath(partialTarget)); !os.IsNotExist(statErr) {
+		t.Errorf("segment record should have been removed once the download completed")
+	}
+}
+
+func TestDoSegmentedDownloadRangesIgnored(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	partialTarget := filepath.Join(tempDir, "testfile"+PartialSuffix)
+
+	_, err := doSegmentedDownload(context.Background(), http.DefaultClient, partialTarget, server.URL, int64(len(content)), 1000, 2, nil, nil, nil, communicator.DefaultRetryPolicy)
+	if err != RangesNotSupported {
+		t.Errorf("doSegmentedDownload should have returned RangesNotSupported, got %v", err)
+	}
+	if _, statErr := os.Stat(partialTarget); !os.IsNotExist(statErr) {
+		t.Errorf("segmented partial should have been removed when falling back to a single stream")
+	}
+}
+
+func TestDoSegmentedDownloadFailures(t *testing.T) {
+	retryPolicy := communicator.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	for _, statusCode := range []int{403, 503} {
+		var requestsMutex sync.Mutex
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestsMutex.Lock()
+			requests += 1
+			requestsMutex.Unlock()
+			w.WriteHeader(statusCode)
+		}))
+		tempDir, _ := ioutil.TempDir("", "autopull-test")
+		partialTarget := filepath.Join(tempDir, "testfile"+PartialSuffix)
+
+		shouldRetry, err := doSegmentedDownload(context.Background(), http.DefaultClient, partialTarget, server.URL, 1000, 1000, 1, nil, nil, nil, retryPolicy)
+		server.Close()
+		os.RemoveAll(tempDir)
+
+		if err == nil {
+			t.Errorf("%d: expected an error", statusCode)
+		}
+		//the segment has already been retried as much as it should be, so the caller must not try again
+		if shouldRetry {
+			t.Errorf("%d: segment failure should not be retried by the caller", statusCode)
+		}
+		expectedRequests := 1
+		if statusCode == 503 {
+			expectedRequests = retryPolicy.MaxAttempts
+		}
+		if requests != expectedRequests {
+			t.Errorf("%d: expected %d requests, got %d", statusCode, expectedRequests, requests)
+		}
+	}
+}
+
+func TestSpaceNeeded(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	ioutil.WriteFile(filepath.Join(tempDir, "present.mov"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(tempDir, "partial.mov"+PartialSuffix), make([]byte, 300), 0644)
+
+	entries := []communicator.ArchiveEntryDownloadSynopsis{
+		{EntryId: "e1", Path: "present.mov", FileSize: 100},
+		{EntryId: "e2", Path: "partial.mov", FileSize: 1000},
+		{EntryId: "e3", Path: "new.mov", FileSize: 2000},
+		{EntryId: "e4", Path: "../outside.mov", FileSize: 5000},
+	}
+
+	mgr := NewDownloadManager(&communicator.Communicator{}, "token", Options{BasePath: tempDir, ConflictPolicy: ConflictSkip}).(*DownloadManagerImpl)
+	if needed := mgr.SpaceNeeded(entries); needed != 2700 {
+		t.Errorf("expected 2700 bytes to be needed when skipping existing files, got %d", needed)
+	}
+
+	mgr.ConflictPolicy = ConflictOverwrite
+	if needed := mgr.SpaceNeeded(entries); needed != 2800 {
+		t.Errorf("expected 2800 bytes to be needed when overwriting existing files, got %d", needed)
+	}
+}
+
+func TestPlanLocal(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	ioutil.WriteFile(filepath.Join(tempDir, "present.mov"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(tempDir, "partial.mov"+PartialSuffix), make([]byte, 300), 0644)
+
+	mgr := NewDownloadManager(&communicator.Communicator{}, "token", Options{BasePath: tempDir, ConflictPolicy: ConflictRename}).(*DownloadManagerImpl)
+	expected := map[string]PlanAction{
+		"present.mov":    ActionRename,
+		"partial.mov":    ActionResume,
+		"new.mov":        ActionDownload,
+		"../outside.mov": ActionUnsafePath,
+	}
+	for path, action := range expected {
+		plan := mgr.planLocal(&communicator.ArchiveEntryDownloadSynopsis{Path: path, FileSize: 1000})
+		if plan.Action != action {
+			t.Errorf("expected %s to be planned as %s but got %s", path, action, plan.Action)
+		}
+	}
+
+	renamed := mgr.planLocal(&communicator.ArchiveEntryDownloadSynopsis{Path: "present.mov", FileSize: 1000})
+	if renamed.LocalPath != filepath.Join(tempDir, "present (1).mov") || !renamed.Renamed {
+		t.Errorf("expected present.mov to be downloaded as 'present (1).mov' but got %s", renamed.LocalPath)
+	}
+}
+
+func TestRecordResultRenames(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+	mgr := NewDownloadManager(&communicator.Communicator{}, "token", Options{BasePath: tempDir, PathMapping: PathMappingPortable}).(*DownloadManagerImpl)
+
+	conflicted := &DownloadResult{Entry: communicator.ArchiveEntryDownloadSynopsis{Path: "present.mov"}, LocalPath: filepath.Join(tempDir, "present (1).mov")}
+	mapped := &DownloadResult{Entry: communicator.ArchiveEntryDownloadSynopsis{Path: "what?.mov"}}
+	mgr.outstanding.Add(2)
+	mgr.recordResult(conflicted)
+	mgr.recordResult(mapped)
+
+	if !conflicted.ConflictRenamed || conflicted.Renamed {
+		t.Errorf("a download renamed because of a conflict should only be marked ConflictRenamed but got %v, %v", conflicted.ConflictRenamed, conflicted.Renamed)
+	}
+	if mapped.ConflictRenamed || !mapped.Renamed {
+		t.Errorf("a download renamed by the path mapping should only be marked Renamed but got %v, %v", mapped.ConflictRenamed, mapped.Renamed)
+	}
+}
+
+func TestPlanLocalSegmentedPartial(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+
+	//a segmented partial is allocated at full size, with only two of its four segments done
+	partialTarget := filepath.Join(tempDir, "big.mov"+PartialSuffix)
+	ioutil.WriteFile(partialTarget, make([]byte, 4000), 0644)
+	record := newSegmentState(4000, 1000)
+	record.Done[0] = true
+	record.Done[2] = true
+	record.save(partialTarget)
+	//a contiguous partial from a single-stream download, which only keeps whole segments
+	ioutil.WriteFile(filepath.Join(tempDir, "single.mov"+PartialSuffix), make([]byte, 2500), 0644)
+
+	mgr := NewDownloadManager(&communicator.Communicator{}, "token", Options{
+		BasePath:         tempDir,
+		SegmentThreshold: 2000,
+		SegmentSize:      1000,
+		SegmentStreams:   2,
+	}).(*DownloadManagerImpl)
+
+	expected := map[string]int64{
+		"big.mov":    2000,
+		"single.mov": 2000,
+	}
+	for path, needed := range expected {
+		plan := mgr.planLocal(&communicator.ArchiveEntryDownloadSynopsis{Path: path, FileSize: 4000})
+		if plan.BytesNeeded != needed || plan.Action != ActionResume {
+			t.Errorf("%s: expected to resume needing %d bytes, got %s needing %d", path, needed, plan.Action, plan.BytesNeeded)
+		}
+	}
+
+	//if it won't be downloaded in segments any more, the segmented partial is thrown away
+	mgr.SegmentThreshold = 0
+	if plan := mgr.planLocal(&communicator.ArchiveEntryDownloadSynopsis{Path: "big.mov", FileSize: 4000}); plan.BytesNeeded != 4000 {
+		t.Errorf("expected a discarded segmented partial to need all 4000 bytes, got %d", plan.BytesNeeded)
+	}
+	if _, statErr := os.Stat(segmentsPath(partialTarget)); statErr != nil {
+		t.Errorf("planning must not change the partial download")
+	}
+}
@@ -0,0 +1,84 @@
+package downloadmanager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+//suffix for the sidecar file that content is downloaded into before being moved into place
+const PartialSuffix = ".autopull-partial"
+
+//verification failures. These are retryable, but if we run out of retries the partial is known-bad and is removed
+var ShortDownload = errors.New("downloaded fewer bytes than expected")
+var OversizedDownload = errors.New("downloaded more bytes than expected")
+
+func isVerificationFailure(err error) bool {
+	return err == ChecksumMismatch || err == ShortDownload || err == OversizedDownload
+}
+
+func partialPath(pathTarget string) string {
+	return pathTarget + PartialSuffix
+}
+
+/**
+checks for a partial download left over from a previous attempt or run.
+returns true if there is one that can be resumed. Partials that can't be valid (bigger than the expected size) are
+removed.
+*/
+func checkPartial(partialTarget string, expectedSize int64) (bool, error) {
+	info, statErr := os.Stat(partialTarget)
+	if statErr != nil {
+		if os.IsNotExist(statErr) {
+			return false, nil
+		}
+		log.Printf("ERROR DownloadManager.checkPartial could not check for existing partial download: %s", statErr)
+		return false, statErr
+	}
+
+	if info.Size() > expectedSize {
+		log.Printf("WARN DownloadManager.checkPartial stale partial download %s is larger than expected (%d > %d), removing it", partialTarget, info.Size(), expectedSize)
+		if rmErr := os.Remove(partialTarget); rmErr != nil {
+			return false, rmErr
+		}
+		return false, nil
+	}
+	log.Printf("INFO DownloadManager.checkPartial found partial download %s of %d/%d bytes, resuming", partialTarget, info.Size(), expectedSize)
+	return true, nil
+}
+
+/**
+removes a partial download that is no longer wanted, if one exists
+*/
+func removeStalePartial(partialTarget string) {
+	os.Remove(segmentsPath(partialTarget))
+	rmErr := os.Remove(partialTarget)
+	if rmErr == nil {
+		log.Printf("INFO DownloadManager.removeStalePartial removed stale partial download %s", partialTarget)
+	} else if !os.IsNotExist(rmErr) {
+		log.Printf("WARN DownloadManager.removeStalePartial could not remove stale partial download %s: %s", partialTarget, rmErr)
+	}
+}
+
+/**
+checks that the completed partial download is what we expected and moves it into place at pathTarget
+*/
+func finaliseDownload(partialTarget string, pathTarget string, expectedSize int64) error {
+	info, statErr := os.Stat(partialTarget)
+	if statErr != nil {
+		log.Printf("ERROR DownloadManager.finaliseDownload could not check downloaded file %s: %s", partialTarget, statErr)
+		return statErr
+	}
+	if info.Size() != expectedSize {
+		log.Printf("ERROR DownloadManager.finaliseDownload %s has the wrong size, expected %d got %d. Not moving it into place.", partialTarget, expectedSize, info.Size())
+		return fmt.Errorf("downloaded file had the wrong size, expected %d got %d", expectedSize, info.Size())
+	}
+
+	renameErr := os.Rename(partialTarget, pathTarget)
+	if renameErr != nil {
+		log.Printf("ERROR DownloadManager.finaliseDownload could not move %s into place: %s", partialTarget, renameErr)
+		return renameErr
+	}
+	return nil
+}
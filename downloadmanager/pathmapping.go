@@ -0,0 +1,145 @@
+package downloadmanager
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type PathMapping string
+
+const (
+	PathMappingNone     PathMapping = "none"     //write paths exactly as they come from the archive
+	PathMappingPortable PathMapping = "portable" //rewrite names that Windows, macOS or SMB shares would reject
+)
+
+func ParsePathMapping(name string) (PathMapping, error) {
+	switch strings.ToLower(name) {
+	case "", "portable":
+		return PathMappingPortable, nil
+	case "none":
+		return PathMappingNone, nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid filename mapping, expected portable or none", name)
+	}
+}
+
+//longest file or directory name that most filesystems accept
+const maxComponentBytes = 255
+
+//characters that are not allowed in names on Windows or SMB shares
+const illegalNameChars = `<>:"|?*\`
+
+var reservedNameRegex = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[0-9]|LPT[0-9])(\..*)?$`)
+var percentEscapeRegex = regexp.MustCompile(`^%[0-9A-Fa-f]{2}`)
+
+func escapeByte(b byte) string {
+	return fmt.Sprintf("%%%02X", b)
+}
+
+/**
+rewrites a single file or directory name so that it is legal everywhere. Problem characters are replaced with
+%XX escapes, the same as in URLs, so the original can always be recovered with UnmapPath. A '%' is only escaped when it
+would otherwise look like the start of an escape, so that most names containing one are left alone.
+Names that are too long can't be shortened reversibly, so they are truncated with a hash of the original name added
+to keep them unique.
+*/
+func mapComponent(name string) string {
+	//leave these alone, confinePath deals with them
+	if name == "." || name == ".." {
+		return name
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(name); i += 1 {
+		b := name[i]
+		if b < 0x20 || b == 0x7f || strings.IndexByte(illegalNameChars, b) >= 0 {
+			builder.WriteString(escapeByte(b))
+		} else if b == '%' && percentEscapeRegex.MatchString(name[i:]) {
+			builder.WriteString(escapeByte(b))
+		} else {
+			builder.WriteByte(b)
+		}
+	}
+	mapped := builder.String()
+
+	//Windows silently drops trailing dots and spaces, so escape them
+	trimmed := strings.TrimRight(mapped, ". ")
+	if len(trimmed) != len(mapped) {
+		var tail strings.Builder
+		for i := len(trimmed); i < len(mapped); i += 1 {
+			tail.WriteString(escapeByte(mapped[i]))
+		}
+		mapped = trimmed + tail.String()
+	}
+
+	if reservedNameRegex.MatchString(mapped) {
+		mapped = escapeByte(mapped[0]) + mapped[1:]
+	}
+
+	if len(mapped) > maxComponentBytes {
+		mapped = shortenComponent(name, mapped)
+	}
+	return mapped
+}
+
+/**
+cuts a long name down to size, keeping the extension and adding a hash of the original so that it stays unique
+*/
+func shortenComponent(original string, mapped string) string {
+	hash := sha1.Sum([]byte(original))
+	suffix := "~" + hex.EncodeToString(hash[:4])
+
+	ext := path.Ext(mapped)
+	if len(ext) > 32 {
+		ext = ""
+	}
+	stem := mapped[:len(mapped)-len(ext)]
+	keep := maxComponentBytes - len(suffix) - len(ext)
+	stem = stem[:keep]
+	//don't leave half of a multi-byte character or escape at the end
+	for len(stem) > 0 && stem[len(stem)-1]&0xC0 == 0x80 {
+		stem = stem[:len(stem)-1]
+	}
+	if len(stem) > 0 && stem[len(stem)-1]&0xC0 == 0xC0 {
+		stem = stem[:len(stem)-1]
+	}
+	if pos := strings.LastIndex(stem, "%"); pos >= 0 && pos >= len(stem)-2 {
+		stem = stem[:pos]
+	}
+	return stem + suffix + ext
+}
+
+/**
+rewrites a server-supplied path according to the given mapping. The result still uses forward slashes.
+*/
+func MapPath(entryPath string, mapping PathMapping) string {
+	if mapping == PathMappingNone {
+		return entryPath
+	}
+	components := strings.Split(entryPath, "/")
+	for i, component := range components {
+		components[i] = mapComponent(component)
+	}
+	return strings.Join(components, "/")
+}
+
+/**
+recovers the original path from one produced by MapPath, except for names that had to be shortened
+*/
+func UnmapPath(localPath string) string {
+	var builder strings.Builder
+	for i := 0; i < len(localPath); i += 1 {
+		if localPath[i] == '%' && percentEscapeRegex.MatchString(localPath[i:]) {
+			decoded, _ := hex.DecodeString(localPath[i+1 : i+3])
+			builder.Write(decoded)
+			i += 2
+		} else {
+			builder.WriteByte(localPath[i])
+		}
+	}
+	return builder.String()
+}
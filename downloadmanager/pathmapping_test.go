@@ -0,0 +1,50 @@
+package downloadmanager
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMapPath(t *testing.T) {
+	cases := map[string]string{
+		"project/clip.mov":          "project/clip.mov",
+		"project/take 1: wide?.mov": "project/take 1%3A wide%3F.mov",
+		"project/trailing. ":        "project/trailing%2E%20",
+		"project/CON":               "project/%43ON",
+		"aux.txt":                   "%61ux.txt",
+		"50%off/a%41.mov":           "50%off/a%2541.mov",
+		"back\\slash":               "back%5Cslash",
+		"../escape":                 "../escape",
+	}
+	for original, expected := range cases {
+		mapped := MapPath(original, PathMappingPortable)
+		if mapped != expected {
+			t.Errorf("MapPath of '%s' should have been '%s' but got '%s'", original, expected, mapped)
+		}
+		if unmapped := UnmapPath(mapped); unmapped != original {
+			t.Errorf("UnmapPath of '%s' should have been '%s' but got '%s'", mapped, original, unmapped)
+		}
+	}
+
+	if MapPath("take 1: wide?.mov", PathMappingNone) != "take 1: wide?.mov" {
+		t.Errorf("MapPath should not change anything with PathMappingNone")
+	}
+}
+
+func TestMapPathLongName(t *testing.T) {
+	longName := strings.Repeat("a", 300) + ".mov"
+	mapped := MapPath("dir/"+longName, PathMappingPortable)
+	parts := strings.Split(mapped, "/")
+	if len(parts[1]) > maxComponentBytes {
+		t.Errorf("long name should have been shortened to %d bytes but was %d", maxComponentBytes, len(parts[1]))
+	}
+	if !strings.HasSuffix(parts[1], ".mov") {
+		t.Errorf("shortened name should have kept its extension but got %s", parts[1])
+	}
+	if MapPath("dir/"+longName, PathMappingPortable) != mapped {
+		t.Errorf("shortening should be stable")
+	}
+	if MapPath("dir/"+longName+"x", PathMappingPortable) == mapped {
+		t.Errorf("different long names should not map to the same thing")
+	}
+}
@@ -0,0 +1,71 @@
+package downloadmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+//returned when an entry's path would put it outside the download folder
+var UnsafePath = errors.New("entry path is not safe")
+
+var windowsVolumeRegex = regexp.MustCompile(`^[A-Za-z]:`)
+
+/**
+works out where the given server-supplied entry path should be written under basePath, making sure that it can't
+end up anywhere else. Leading slashes are ignored, as they always have been, but anything that tries to climb out of
+the download folder (via "..", a drive letter or a symlinked directory) is rejected with an error wrapping UnsafePath.
+*/
+func confinePath(basePath string, entryPath string) (string, error) {
+	if strings.ContainsRune(entryPath, 0) {
+		return "", fmt.Errorf("%w: '%s' contains a null character", UnsafePath, entryPath)
+	}
+
+	//treat both kinds of slash as separators, so that a Windows-style "..\" can't sneak through
+	slashed := strings.Replace(entryPath, "\\", "/", -1)
+	if runtime.GOOS == "windows" && windowsVolumeRegex.MatchString(slashed) {
+		return "", fmt.Errorf("%w: '%s' is an absolute path", UnsafePath, entryPath)
+	}
+
+	cleaned := path.Clean(strings.TrimLeft(slashed, "/"))
+	if cleaned == "." || cleaned == "" {
+		return "", fmt.Errorf("%w: '%s' does not name a file", UnsafePath, entryPath)
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: '%s' is outside the download folder", UnsafePath, entryPath)
+	}
+
+	target := filepath.Join(basePath, filepath.FromSlash(cleaned))
+	if symlinkErr := checkNoSymlinks(basePath, cleaned); symlinkErr != nil {
+		return "", fmt.Errorf("%w: '%s' %s", UnsafePath, entryPath, symlinkErr)
+	}
+	return target, nil
+}
+
+/**
+checks that none of the components of relPath under basePath that already exist are symlinks, so that we can't be
+tricked into writing through a link to somewhere else
+*/
+func checkNoSymlinks(basePath string, relPath string) error {
+	current := basePath
+	for _, component := range strings.Split(relPath, "/") {
+		current = filepath.Join(current, component)
+		info, statErr := os.Lstat(current)
+		if statErr != nil {
+			if os.IsNotExist(statErr) {
+				//nothing further down can exist yet
+				return nil
+			}
+			return statErr
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("goes through a symlink at %s", current)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package downloadmanager
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestConfinePath(t *testing.T) {
+	base := filepath.Join("tmp", "downloads")
+
+	target, err := confinePath(base, "project/footage/clip.mov")
+	if err != nil || target != filepath.Join(base, "project", "footage", "clip.mov") {
+		t.Errorf("confinePath should have accepted a normal path but got %s, %s", target, err)
+	}
+
+	target, err = confinePath(base, "/project/clip.mov")
+	if err != nil || target != filepath.Join(base, "project", "clip.mov") {
+		t.Errorf("confinePath should have treated a leading slash as relative but got %s, %s", target, err)
+	}
+
+	target, err = confinePath(base, "project/../other/clip.mov")
+	if err != nil || target != filepath.Join(base, "other", "clip.mov") {
+		t.Errorf("confinePath should have accepted a path that stays inside but got %s, %s", target, err)
+	}
+
+	for _, badPath := range []string{"../../.bashrc", "project/../../.bashrc", "..\\..\\evil.exe", "..", "", "/"} {
+		_, err = confinePath(base, badPath)
+		if !errors.Is(err, UnsafePath) {
+			t.Errorf("confinePath should have rejected '%s' but got %v", badPath, err)
+		}
+	}
+}
+
+func TestConfinePathSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+	base, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(base)
+	outside, _ := ioutil.TempDir("", "autopull-outside")
+	defer os.RemoveAll(outside)
+
+	os.Symlink(outside, filepath.Join(base, "linked"))
+	_, err := confinePath(base, "linked/clip.mov")
+	if !errors.Is(err, UnsafePath) {
+		t.Errorf("confinePath should have rejected a path through a symlink but got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package downloadmanager
+
+import (
+	"context"
+	"github.com/guardian/autopull/communicator"
+	"os"
+	"sync"
+)
+
+type PlanAction string
+
+const (
+	ActionDownload          PlanAction = "download"
+	ActionResume            PlanAction = "resume"             //carry on from a partial download
+	ActionOverwrite         PlanAction = "overwrite"          //replace a file that is already there
+	ActionRename            PlanAction = "rename"             //a file is already there, download alongside it under another name
+	ActionSkipExists        PlanAction = "skip-exists"        //a file is already there and will be left alone
+	ActionAlreadyDownloaded PlanAction = "already-downloaded" //a previous run downloaded it
+	ActionFailRun           PlanAction = "fail-run"           //a file is already there and the conflict policy would stop the run
+	ActionUnsafePath        PlanAction = "reject-unsafe-path" //the path would put it outside the download folder
+)
+
+/**
+returns true if the action involves downloading something
+*/
+func (a PlanAction) Downloads() bool {
+	return a == ActionDownload || a == ActionResume || a == ActionOverwrite || a == ActionRename
+}
+
+/**
+what would happen to an entry if it were downloaded now
+*/
+type EntryPlan struct {
+	Entry         communicator.ArchiveEntryDownloadSynopsis
+	LocalPath     string
+	Renamed       bool //true if the local name is different to the name on the server
+	Action        PlanAction
+	BytesNeeded   int64  //how much disk space downloading it would take
+	RestoreStatus string //the restore status reported by the server. Only looked up for entries that would be downloaded
+	Error         error  //set if the restore status could not be found or the path is not allowed
+}
+
+/**
+returns true if the server says that the entry can be downloaded straight away
+*/
+func (p *EntryPlan) Available() bool {
+	switch p.RestoreStatus {
+	case "RS_UNNEEDED", "RS_ALREADY", "RS_SUCCESS":
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+works out what would happen to the entry from what is in the download folder, without asking the server anything.
+Under the overwrite-if-different policy, files are compared on size only.
+*/
+func (d *DownloadManagerImpl) planLocal(entry *communicator.ArchiveEntryDownloadSynopsis) *EntryPlan {
+	plan := &EntryPlan{Entry: *entry}
+	pathTarget, pathErr := d.localPathFor(entry)
+	if pathErr != nil {
+		plan.Action = ActionUnsafePath
+		plan.Error = pathErr
+		return plan
+	}
+	plan.LocalPath = pathTarget
+	plan.Renamed = MapPath(entry.Path, d.PathMapping) != entry.Path
+
+	if d.State != nil {
+		if completed := d.State.CompletedEntry(d.LongLivedToken, entry); completed != nil {
+			plan.Action = ActionAlreadyDownloaded
+			plan.LocalPath = completed.LocalPath
+			return plan
+		}
+	}
+
+	plan.Action = ActionDownload
+	if info, statErr := os.Stat(pathTarget); statErr == nil {
+		switch d.ConflictPolicy {
+		case ConflictOverwrite:
+			plan.Action = ActionOverwrite
+		case ConflictOverwriteIfDifferent:
+			if info.Size() == entry.FileSize {
+				plan.Action = ActionSkipExists
+				return plan
+			}
+			plan.Action = ActionOverwrite
+		case ConflictRename:
+			freeName, nameErr := findFreeName(pathTarget, entry.FileSize)
+			if nameErr != nil {
+				plan.Error = nameErr
+			} else {
+				plan.LocalPath = freeName
+				plan.Renamed = true
+			}
+			plan.Action = ActionRename
+		case ConflictFailRun:
+			plan.Action = ActionFailRun
+			return plan
+		default:
+			plan.Action = ActionSkipExists
+			return plan
+		}
+	}
+
+	plan.BytesNeeded = entry.FileSize
+	if done := d.partialBytesDone(entry, partialPath(plan.LocalPath)); done > 0 {
+		plan.BytesNeeded -= done
+		if plan.Action == ActionDownload {
+			plan.Action = ActionResume
+		}
+	}
+	return plan
+}
+
+/**
+returns true if the entry is big enough to be downloaded in segments
+*/
+func (d *DownloadManagerImpl) isSegmented(entry *communicator.ArchiveEntryDownloadSynopsis) bool {
+	return d.SegmentThreshold > 0 && d.SegmentSize > 0 && d.SegmentStreams > 0 && entry.FileSize >= d.SegmentThreshold
+}
+
+/**
+returns how much of the entry a download would be able to keep from the partial that is already there.
+A segmented partial is allocated at full size straight away, so for those the segment record says how much is done.
+*/
+func (d *DownloadManagerImpl) partialBytesDone(entry *communicator.ArchiveEntryDownloadSynopsis, partialTarget string) int64 {
+	_, segmentsErr := os.Stat(segmentsPath(partialTarget))
+	haveSegments := segmentsErr == nil
+	if haveSegments {
+		if !d.isSegmented(entry) {
+			//performDownload throws these away, they can't be resumed as a single stream
+			return 0
+		}
+		if existing, usable := readSegmentState(partialTarget, entry.FileSize, d.SegmentSize); usable {
+			return existing.bytesDone()
+		}
+		return 0
+	}
+	if info, statErr := os.Stat(partialTarget); statErr == nil && info.Size() <= entry.FileSize {
+		if d.isSegmented(entry) {
+			//only whole segments are kept from a single-stream partial
+			return newSegmentStateFromPartial(entry.FileSize, d.SegmentSize, info.Size()).bytesDone()
+		}
+		return info.Size()
+	}
+	return 0
+}
+
+/**
+works out what would happen to each of the entries if they were downloaded now, and asks the server whether the ones
+that would be downloaded are available yet. Nothing is downloaded or written.
+*/
+func (d *DownloadManagerImpl) Plan(ctx context.Context, entries []communicator.ArchiveEntryDownloadSynopsis) []*EntryPlan {
+	plans := make([]*EntryPlan, len(entries))
+	for i := range entries {
+		plans[i] = d.planLocal(&entries[i])
+	}
+
+	pending := make(chan *EntryPlan, len(plans))
+	for _, plan := range plans {
+		if plan.Action.Downloads() {
+			pending <- plan
+		}
+	}
+	close(pending)
+
+	workers := d.DownloadThreadCount
+	if workers < 1 {
+		workers = 1
+	}
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(workers)
+	for i := 0; i < workers; i += 1 {
+		go func() {
+			defer waitGroup.Done()
+			for plan := range pending {
+				if ctx.Err() != nil {
+					plan.Error = ctx.Err()
+					continue
+				}
+				linkInfo, linkErr := d.Communicator.GetItemLink(ctx, d.LongLivedToken, plan.Entry.EntryId)
+				if linkErr != nil {
+					plan.Error = linkErr
+				} else {
+					plan.RestoreStatus = linkInfo.RestoreStatus
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+	return plans
+}
+
+/**
+works out how much disk space downloading the given entries will take, leaving out files that are already present and
+will be skipped and data that is already in partial downloads
+*/
+func (d *DownloadManagerImpl) SpaceNeeded(entries []communicator.ArchiveEntryDownloadSynopsis) int64 {
+	var total int64 = 0
+	for i := range entries {
+		total += d.planLocal(&entries[i]).BytesNeeded
+	}
+	return total
+}
@@ -0,0 +1,174 @@
+package downloadmanager
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ProgressTracker keeps count of how far through the run we are, overall and for each download thread.
+It is safe to call any of its methods on a nil tracker, which does nothing.
+*/
+type ProgressTracker struct {
+	mutex            sync.Mutex
+	startTime        time.Time
+	filesTotal       int
+	filesDone        int
+	bytesTotal       int64
+	bytesCompleted   int64 //bytes in files that have finished downloading
+	bytesTransferred int64 //bytes actually received over the network during this run. Must only be accessed with sync/atomic
+	workers          []*FileProgress
+}
+
+/**
+progress of a single file being downloaded by a download thread
+*/
+type FileProgress struct {
+	tracker    *ProgressTracker
+	Path       string
+	BytesTotal int64
+	bytesDone  int64 //must only be accessed with sync/atomic
+}
+
+type WorkerSnapshot struct {
+	Active     bool
+	Path       string
+	BytesDone  int64
+	BytesTotal int64
+}
+
+type ProgressSnapshot struct {
+	Elapsed          time.Duration
+	FilesDone        int
+	FilesTotal       int
+	BytesDone        int64
+	BytesTotal       int64
+	BytesTransferred int64
+	Workers          []WorkerSnapshot
+}
+
+func NewProgressTracker(filesTotal int, bytesTotal int64, workerCount int) *ProgressTracker {
+	return &ProgressTracker{
+		startTime:  time.Now(),
+		filesTotal: filesTotal,
+		bytesTotal: bytesTotal,
+		workers:    make([]*FileProgress, workerCount),
+	}
+}
+
+/**
+registers that the given worker has started downloading a file, returning the FileProgress to update as it goes
+*/
+func (p *ProgressTracker) StartFile(workerId int, path string, size int64) *FileProgress {
+	if p == nil {
+		return nil
+	}
+	fp := &FileProgress{tracker: p, Path: path, BytesTotal: size}
+	p.mutex.Lock()
+	if workerId >= 0 && workerId < len(p.workers) {
+		p.workers[workerId] = fp
+	}
+	p.mutex.Unlock()
+	return fp
+}
+
+/**
+registers that the given worker is no longer downloading anything
+*/
+func (p *ProgressTracker) FinishFile(workerId int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	if workerId >= 0 && workerId < len(p.workers) {
+		p.workers[workerId] = nil
+	}
+	p.mutex.Unlock()
+}
+
+/**
+registers that an item has been finished with. If it was not downloaded then its size is taken off the total, so
+that the figures reflect what we actually expect to transfer
+*/
+func (p *ProgressTracker) ItemCompleted(size int64, downloaded bool) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.filesDone += 1
+	if downloaded {
+		p.bytesCompleted += size
+	} else {
+		p.bytesTotal -= size
+	}
+	p.mutex.Unlock()
+}
+
+func (p *ProgressTracker) Snapshot() ProgressSnapshot {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	snapshot := ProgressSnapshot{
+		Elapsed:          time.Since(p.startTime),
+		FilesDone:        p.filesDone,
+		FilesTotal:       p.filesTotal,
+		BytesDone:        p.bytesCompleted,
+		BytesTotal:       p.bytesTotal,
+		BytesTransferred: atomic.LoadInt64(&p.bytesTransferred),
+		Workers:          make([]WorkerSnapshot, len(p.workers)),
+	}
+	for i, fp := range p.workers {
+		if fp != nil {
+			done := atomic.LoadInt64(&fp.bytesDone)
+			snapshot.BytesDone += done
+			snapshot.Workers[i] = WorkerSnapshot{
+				Active:     true,
+				Path:       fp.Path,
+				BytesDone:  done,
+				BytesTotal: fp.BytesTotal,
+			}
+		}
+	}
+	return snapshot
+}
+
+/**
+sets how much of the file we have, e.g. when resuming or starting again
+*/
+func (fp *FileProgress) Set(bytesDone int64) {
+	if fp == nil {
+		return
+	}
+	atomic.StoreInt64(&fp.bytesDone, bytesDone)
+}
+
+func (fp *FileProgress) add(count int64) {
+	if fp == nil {
+		return
+	}
+	atomic.AddInt64(&fp.bytesDone, count)
+	atomic.AddInt64(&fp.tracker.bytesTransferred, count)
+}
+
+/**
+wraps the given reader so that everything read through it is counted against this file
+*/
+func (fp *FileProgress) WrapReader(r io.Reader) io.Reader {
+	if fp == nil {
+		return r
+	}
+	return &countingReader{reader: r, progress: fp}
+}
+
+type countingReader struct {
+	reader   io.Reader
+	progress *FileProgress
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.progress.add(int64(n))
+	return n, err
+}
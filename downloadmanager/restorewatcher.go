@@ -0,0 +1,218 @@
+package downloadmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"log"
+	"sync"
+	"time"
+)
+
+//how often the watcher looks for items that are due to be checked on, if Options.RestoreCheckInterval isn't set
+const defaultRestoreCheckInterval = 1 * time.Second
+
+type deferredItem struct {
+	entry         communicator.ArchiveEntryDownloadSynopsis
+	firstDeferred time.Time
+	nextPoll      time.Time
+	interval      time.Duration
+	lastResponse  *communicator.DownloadManagerItemResponse //what the server said about the item the last time we asked
+}
+
+/**
+restoreWatcher holds on to items that are still being restored from Glacier (or that we have asked to be restored), and periodically asks the server about
+them again. Once an item becomes available it is put back onto the download queue; if it takes longer than
+RestoreMaxWait then we give up on it.
+*/
+type restoreWatcher struct {
+	mgr      *DownloadManagerImpl
+	mutex    sync.Mutex
+	waiting  []*deferredItem
+	started  map[string]time.Time //when we first found each item waiting for restore, so this survives being requeued
+	stopChan chan struct{}
+	tick     time.Duration
+}
+
+func newRestoreWatcher(mgr *DownloadManagerImpl) *restoreWatcher {
+	tick := mgr.RestoreCheckInterval
+	if tick <= 0 {
+		tick = defaultRestoreCheckInterval
+	}
+	return &restoreWatcher{
+		mgr:      mgr,
+		waiting:  make([]*deferredItem, 0),
+		started:  make(map[string]time.Time),
+		stopChan: make(chan struct{}),
+		tick:     tick,
+	}
+}
+
+/**
+adds an item to be checked on later. The item remains outstanding on the download manager until it is either
+requeued or given up on.
+*/
+func (w *restoreWatcher) Add(entry communicator.ArchiveEntryDownloadSynopsis) {
+	if w.mgr.isStopping() {
+		w.mgr.itemCompleted(&entry, StatusCancelled, RunStopped, time.Now())
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	firstDeferred, haveStarted := w.started[entry.EntryId]
+	if !haveStarted {
+		firstDeferred = now
+		w.started[entry.EntryId] = now
+	}
+	w.waiting = append(w.waiting, &deferredItem{
+		entry:         entry,
+		firstDeferred: firstDeferred,
+		nextPoll:      now.Add(w.mgr.RestorePollInterval),
+		interval:      w.mgr.RestorePollInterval,
+	})
+}
+
+func (w *restoreWatcher) Stop() {
+	close(w.stopChan)
+}
+
+func (w *restoreWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	mgrStopping := w.mgr.stopChan
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case <-mgrStopping:
+			w.cancelAll()
+			mgrStopping = nil //a closed channel is always ready, so stop selecting on it
+		case <-ticker.C:
+			w.pollDue(ctx)
+		}
+	}
+}
+
+/**
+gives up on everything that is waiting, because the run has been stopped
+*/
+func (w *restoreWatcher) cancelAll() {
+	w.mutex.Lock()
+	waiting := w.waiting
+	w.waiting = make([]*deferredItem, 0)
+	w.mutex.Unlock()
+
+	for _, item := range waiting {
+		w.mgr.itemCompleted(&item.entry, StatusCancelled, RunStopped, time.Now())
+	}
+}
+
+/**
+takes out the items that are due to be checked, leaving the rest in the waiting list
+*/
+func (w *restoreWatcher) takeDue(now time.Time) []*deferredItem {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	due := make([]*deferredItem, 0)
+	remaining := make([]*deferredItem, 0, len(w.waiting))
+	for _, item := range w.waiting {
+		if now.After(item.nextPoll) {
+			due = append(due, item)
+		} else {
+			remaining = append(remaining, item)
+		}
+	}
+	w.waiting = remaining
+	return due
+}
+
+func (w *restoreWatcher) putBack(item *deferredItem) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.waiting = append(w.waiting, item)
+}
+
+func (w *restoreWatcher) pollDue(ctx context.Context) {
+	for _, item := range w.takeDue(time.Now()) {
+		if w.mgr.isStopping() {
+			w.mgr.itemCompleted(&item.entry, StatusCancelled, RunStopped, time.Now())
+			continue
+		}
+		linkInfo, err := w.mgr.Communicator.GetItemLink(ctx, w.mgr.LongLivedToken, item.entry.EntryId)
+		if ctx.Err() != nil {
+			w.mgr.itemCompleted(&item.entry, StatusCancelled, RunStopped, time.Now())
+			continue
+		}
+		if errors.Is(err, communicator.ErrTokenInvalid) {
+			log.Printf("ERROR DownloadManager.restoreWatcher the server no longer accepts the download token, stopping")
+			w.mgr.itemCompleted(&item.entry, StatusFailed, err, time.Now())
+			w.mgr.Stop()
+			continue
+		} else if err != nil {
+			log.Printf("WARN DownloadManager.restoreWatcher could not check on %s, will try again: %s", item.entry.Path, err)
+			w.reschedule(item)
+			continue
+		}
+
+		item.lastResponse = linkInfo
+
+		switch linkInfo.RestoreStatus {
+		case "RS_PENDING":
+			fallthrough
+		case "RS_UNDERWAY":
+			w.reschedule(item)
+		case "RS_UNNEEDED":
+			fallthrough
+		case "RS_ALREADY":
+			fallthrough
+		case "RS_SUCCESS":
+			log.Printf("INFO DownloadManager.restoreWatcher %s has been restored after %s, queueing for download", item.entry.Path, time.Since(item.firstDeferred).Round(time.Second))
+			//don't block the watcher if the download queue is full
+			go func(entry communicator.ArchiveEntryDownloadSynopsis) {
+				w.mgr.incomingChannel <- entry
+			}(item.entry)
+		case "RS_ERROR":
+			fallthrough
+		case "RS_EXPIRED":
+			if w.mgr.requestRestore(ctx, &item.entry) {
+				w.reschedule(item)
+			} else {
+				log.Printf("ERROR DownloadManager.restoreWatcher restore of %s failed, restore status is %s", item.entry.Path, linkInfo.RestoreStatus)
+				w.mgr.itemCompleted(&item.entry, StatusNotRestored, fmt.Errorf("restore failed: %w", linkInfo.NotRestoredError()), time.Now())
+			}
+		default:
+			log.Printf("ERROR DownloadManager.restoreWatcher restore of %s failed, restore status is %s", item.entry.Path, linkInfo.RestoreStatus)
+			w.mgr.itemCompleted(&item.entry, StatusNotRestored, fmt.Errorf("restore failed: %w", linkInfo.NotRestoredError()), time.Now())
+		}
+	}
+}
+
+/**
+puts the item back into the waiting list with a longer interval, or gives up on it if it has been waiting too long
+*/
+func (w *restoreWatcher) reschedule(item *deferredItem) {
+	waited := time.Since(item.firstDeferred)
+	if waited > w.mgr.RestoreMaxWait {
+		log.Printf("ERROR DownloadManager.restoreWatcher giving up on %s, it is still not restored after %s", item.entry.Path, waited.Round(time.Second))
+		var notRestored error = communicator.ErrNotRestored
+		if item.lastResponse != nil {
+			notRestored = item.lastResponse.NotRestoredError()
+		}
+		w.mgr.itemCompleted(&item.entry, StatusNotRestored, fmt.Errorf("still not restored after %s: %w", waited.Round(time.Second), notRestored), time.Now())
+		return
+	}
+
+	item.interval *= 2
+	if item.interval > w.mgr.RestorePollMaxInterval {
+		item.interval = w.mgr.RestorePollMaxInterval
+	}
+	item.nextPoll = time.Now().Add(item.interval)
+	log.Printf("DEBUG DownloadManager.restoreWatcher %s is still restoring, checking again in %s", item.entry.Path, item.interval)
+	w.putBack(item)
+}
@@ -0,0 +1,237 @@
+package downloadmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+a server whose items report RS_PENDING for the first `pendingPolls` requests for their link, then RS_SUCCESS.
+A negative pendingPolls means the restore never finishes.
+*/
+type restoringServer struct {
+	*httptest.Server
+	mutex        sync.Mutex
+	linkRequests int
+}
+
+func newRestoringServer(pendingPolls int, content []byte) *restoringServer {
+	s := &restoringServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/bulk/") {
+			w.Write(content)
+			return
+		}
+		s.mutex.Lock()
+		s.linkRequests += 1
+		count := s.linkRequests
+		s.mutex.Unlock()
+		restoreStatus := "RS_SUCCESS"
+		if pendingPolls < 0 || count <= pendingPolls {
+			restoreStatus = "RS_PENDING"
+		}
+		fmt.Fprintf(w, `{"status":"ok","restoreStatus":"%s","downloadLink":"%s/content"}`, restoreStatus, s.URL)
+	}))
+	return s
+}
+
+func (s *restoringServer) requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.linkRequests
+}
+
+func newRestoreTestManager(t *testing.T, server *restoringServer, maxWait time.Duration) (*DownloadManagerImpl, func()) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	serverUrl, _ := url.Parse(server.URL)
+	comm := &communicator.Communicator{ArchiveHunterUri: *serverUrl, Type: communicator.ArchiveHunter}
+	mgr := NewDownloadManager(comm, "sometoken", Options{
+		ThreadCount:            2,
+		BufferSize:             1,
+		BasePath:               tempDir,
+		RestorePollInterval:    10 * time.Millisecond,
+		RestorePollMaxInterval: 20 * time.Millisecond,
+		RestoreCheckInterval:   5 * time.Millisecond,
+		RestoreMaxWait:         maxWait,
+	}).(*DownloadManagerImpl)
+	return mgr, func() {
+		server.Close()
+		os.RemoveAll(tempDir)
+	}
+}
+
+func TestRestoreWatcherRequeuesWhenRestored(t *testing.T) {
+	content := []byte("restored content")
+	server := newRestoringServer(3, content)
+	mgr, cleanup := newRestoreTestManager(t, server, 10*time.Second)
+	defer cleanup()
+
+	mgr.Init(context.Background())
+	mgr.Enqueue(communicator.ArchiveEntryDownloadSynopsis{EntryId: "abc", Path: "file1", FileSize: int64(len(content))})
+	results := mgr.CompleteAndWait()
+
+	if len(results) != 1 || results[0].Status != StatusDownloaded {
+		t.Fatalf("expected the item to be downloaded once restored, got %v", results)
+	}
+	//3 pending answers, the watcher seeing it restored, then the download thread getting the link again
+	if server.requests() != 5 {
+		t.Errorf("expected 5 requests for the link, got %d", server.requests())
+	}
+}
+
+func TestRestoreWatcherGivesUp(t *testing.T) {
+	server := newRestoringServer(-1, nil)
+	mgr, cleanup := newRestoreTestManager(t, server, 100*time.Millisecond)
+	defer cleanup()
+
+	mgr.Init(context.Background())
+	mgr.Enqueue(communicator.ArchiveEntryDownloadSynopsis{EntryId: "abc", Path: "file1", FileSize: 10})
+	results := mgr.CompleteAndWait()
+
+	if len(results) != 1 || results[0].Status != StatusNotRestored {
+		t.Fatalf("expected the item to be given up on, got %v", results)
+	}
+	if !errors.Is(results[0].Error, communicator.ErrNotRestored) {
+		t.Errorf("expected ErrNotRestored, got %s", results[0].Error)
+	}
+	var responseErr *communicator.ResponseError
+	if !errors.As(results[0].Error, &responseErr) || responseErr.StatusCode != 200 || !strings.Contains(responseErr.Body, "RS_PENDING") {
+		t.Errorf("expected the error to carry the last response from the server, got %#v", results[0].Error)
+	}
+}
+
+func TestRestoreWatcherCancelledOnStop(t *testing.T) {
+	server := newRestoringServer(-1, nil)
+	mgr, cleanup := newRestoreTestManager(t, server, 10*time.Second)
+	defer cleanup()
+
+	mgr.Init(context.Background())
+	mgr.Enqueue(communicator.ArchiveEntryDownloadSynopsis{EntryId: "abc", Path: "file1", FileSize: 10})
+	for server.requests() < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	mgr.Stop()
+	results := mgr.CompleteAndWait()
+
+	if len(results) != 1 || results[0].Status != StatusCancelled {
+		t.Fatalf("expected the waiting item to be cancelled, got %v", results)
+	}
+}
+
+func TestRestoreWatcherBackoff(t *testing.T) {
+	server := newRestoringServer(-1, nil)
+	mgr, cleanup := newRestoreTestManager(t, server, 10*time.Second)
+	defer cleanup()
+	watcher := newRestoreWatcher(mgr)
+
+	item := &deferredItem{firstDeferred: time.Now(), interval: mgr.RestorePollInterval}
+	expected := []time.Duration{20 * time.Millisecond, 20 * time.Millisecond}
+	for _, interval := range expected {
+		watcher.reschedule(item)
+		if item.interval != interval {
+			t.Errorf("expected the interval to be %s, got %s", interval, item.interval)
+		}
+		if due := watcher.takeDue(item.nextPoll.Add(time.Millisecond)); len(due) != 1 {
+			t.Fatalf("expected the item to be due at its next poll time, got %d items", len(due))
+		}
+	}
+	watcher.putBack(item)
+	if due := watcher.takeDue(item.nextPoll); len(due) != 0 {
+		t.Errorf("item should not be due before its next poll time")
+	}
+}
+
+/**
+a server where e1 starts off RS_ERROR and becomes available once a restore has been requested and it has been polled
+once more, and e2 is available straight away
+*/
+func newRestoreRequestServer(restoreRequests *int, mutex *sync.Mutex) *httptest.Server {
+	var server *httptest.Server
+	polls := 0
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/api/bulkv2/sometoken/restore/e1":
+			*restoreRequests += 1
+			w.WriteHeader(202)
+		case r.URL.Path == "/api/bulk/sometoken/get/e1":
+			restoreStatus := "RS_ERROR"
+			if *restoreRequests > 0 {
+				polls += 1
+				if polls == 1 {
+					restoreStatus = "RS_UNDERWAY"
+				} else {
+					restoreStatus = "RS_SUCCESS"
+				}
+			}
+			fmt.Fprintf(w, `{"status":"ok","restoreStatus":"%s","downloadLink":"%s/content"}`, restoreStatus, server.URL)
+		case r.URL.Path == "/api/bulk/sometoken/get/e2":
+			fmt.Fprintf(w, `{"status":"ok","restoreStatus":"RS_UNNEEDED","downloadLink":"%s/content"}`, server.URL)
+		case r.URL.Path == "/content":
+			w.Write([]byte("0123456789"))
+		default:
+			w.WriteHeader(403)
+		}
+	}))
+	return server
+}
+
+func TestRequestRestoreThenWatch(t *testing.T) {
+	tests := []struct {
+		commType        communicator.CommunicatorType
+		expectedStatus  ResultStatus
+		restoreRequests int
+	}{
+		{communicator.ArchiveHunter, StatusDownloaded, 1},
+		//VaultDoor can't restore, so the item is left as not restored and the rest of the run carries on
+		{communicator.VaultDoor, StatusNotRestored, 0},
+	}
+	for _, test := range tests {
+		var mutex sync.Mutex
+		restoreRequests := 0
+		server := newRestoreRequestServer(&restoreRequests, &mutex)
+		tempDir, _ := ioutil.TempDir("", "autopull-test")
+
+		serverUrl, _ := url.Parse(server.URL)
+		comm := &communicator.Communicator{ArchiveHunterUri: *serverUrl, VaultDoorUri: *serverUrl, Type: test.commType}
+		mgr := NewDownloadManager(comm, "sometoken", Options{
+			ThreadCount:            2,
+			BufferSize:             2,
+			BasePath:               tempDir,
+			RestorePollInterval:    10 * time.Millisecond,
+			RestorePollMaxInterval: 20 * time.Millisecond,
+			RestoreCheckInterval:   5 * time.Millisecond,
+			RestoreMaxWait:         10 * time.Second,
+			RestoreTier:            communicator.TierBulk,
+		})
+		mgr.Init(context.Background())
+		mgr.Enqueue(communicator.ArchiveEntryDownloadSynopsis{EntryId: "e1", Path: "file1", FileSize: 10})
+		mgr.Enqueue(communicator.ArchiveEntryDownloadSynopsis{EntryId: "e2", Path: "file2", FileSize: 10})
+		results := mgr.CompleteAndWait()
+		server.Close()
+		os.RemoveAll(tempDir)
+
+		statuses := make(map[string]ResultStatus)
+		for _, result := range results {
+			statuses[result.Entry.EntryId] = result.Status
+		}
+		if statuses["e1"] != test.expectedStatus || statuses["e2"] != StatusDownloaded {
+			t.Errorf("expected e1 %s and e2 downloaded, got %v", test.expectedStatus, statuses)
+		}
+		if restoreRequests != test.restoreRequests {
+			t.Errorf("expected %d restore requests, got %d", test.restoreRequests, restoreRequests)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package downloadmanager
+
+import (
+	"github.com/guardian/autopull/communicator"
+	"time"
+)
+
+type ResultStatus int
+
+const (
+	StatusDownloaded    ResultStatus = iota
+	StatusSkippedExists              //there was already a file at the target path and we were not allowed to overwrite it
+	StatusNotRestored                //the item is not available from the archive yet
+	StatusFailed
+	StatusCancelled  //the run was interrupted before this was finished
+	StatusUnsafePath //security failure, the entry's path would have put it outside the download folder
+	StatusFiltered   //left out by the include/exclude or size filters
+)
+
+func (s ResultStatus) String() string {
+	switch s {
+	case StatusDownloaded:
+		return "downloaded"
+	case StatusSkippedExists:
+		return "skipped-exists"
+	case StatusNotRestored:
+		return "not-restored"
+	case StatusFailed:
+		return "failed"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusUnsafePath:
+		return "rejected-unsafe-path"
+	case StatusFiltered:
+		return "filtered"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+returns true if the status means that the user has got the file
+*/
+func (s ResultStatus) IsSuccess() bool {
+	return s == StatusDownloaded || s == StatusSkippedExists
+}
+
+/**
+the outcome of processing a single entry
+*/
+type DownloadResult struct {
+	Entry           communicator.ArchiveEntryDownloadSynopsis
+	LocalPath       string //where the entry is written to locally. Can differ from the entry path if it had to be rewritten.
+	Renamed         bool   //true if the path had to be rewritten by the path mapping
+	ConflictRenamed bool   //true if the entry was saved under a different name because there was already a file at its path
+	Status          ResultStatus
+	Error           error         //the reason for the failure, if it was not successful
+	Checksum        string        //the checksum that the download was verified against, if there was one
+	Bytes           int64         //how many bytes were downloaded
+	Duration        time.Duration //how long the item took to process, not including any time waiting for a restore
+}
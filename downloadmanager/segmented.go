@@ -0,0 +1,356 @@
+package downloadmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//suffix for the file that records which segments of a segmented download are complete, alongside the partial
+const SegmentsSuffix = ".segments"
+
+//returned when the server won't give us byte ranges, so the file has to be downloaded as a single stream
+var RangesNotSupported = errors.New("server does not support byte range requests")
+
+func segmentsPath(partialTarget string) string {
+	return partialTarget + SegmentsSuffix
+}
+
+/**
+record of which segments of a segmented download have been written to the partial, so that an interrupted download
+can carry on from where it left off
+*/
+type segmentState struct {
+	FileSize    int64  `json:"fileSize"`
+	SegmentSize int64  `json:"segmentSize"`
+	Done        []bool `json:"done"`
+}
+
+func newSegmentState(fileSize int64, segmentSize int64) *segmentState {
+	count := (fileSize + segmentSize - 1) / segmentSize
+	return &segmentState{
+		FileSize:    fileSize,
+		SegmentSize: segmentSize,
+		Done:        make([]bool, count),
+	}
+}
+
+/**
+a new segment record that counts the whole segments at the start of a contiguous partial of partialSize bytes as done
+*/
+func newSegmentStateFromPartial(fileSize int64, segmentSize int64, partialSize int64) *segmentState {
+	state := newSegmentState(fileSize, segmentSize)
+	for i := range state.Done {
+		_, end := state.bounds(i)
+		if end < partialSize {
+			state.Done[i] = true
+		}
+	}
+	return state
+}
+
+/**
+returns the first and last byte (inclusive) of the given segment
+*/
+func (s *segmentState) bounds(index int) (int64, int64) {
+	start := int64(index) * s.SegmentSize
+	end := start + s.SegmentSize - 1
+	if end >= s.FileSize {
+		end = s.FileSize - 1
+	}
+	return start, end
+}
+
+func (s *segmentState) bytesDone() int64 {
+	var total int64 = 0
+	for i, done := range s.Done {
+		if done {
+			start, end := s.bounds(i)
+			total += end - start + 1
+		}
+	}
+	return total
+}
+
+/**
+reads the segment record for the given partial without changing anything. Returns false if there isn't one that can be
+carried on from for a download of this size and segment size.
+*/
+func readSegmentState(partialTarget string, fileSize int64, segmentSize int64) (*segmentState, bool) {
+	content, readErr := ioutil.ReadFile(segmentsPath(partialTarget))
+	if readErr != nil {
+		return nil, false
+	}
+	var existing segmentState
+	if json.Unmarshal(content, &existing) != nil || existing.FileSize != fileSize || existing.SegmentSize != segmentSize ||
+		len(existing.Done) != len(newSegmentState(fileSize, segmentSize).Done) {
+		return nil, false
+	}
+	if _, statErr := os.Stat(partialTarget); statErr != nil {
+		return nil, false
+	}
+	return &existing, true
+}
+
+/**
+loads the segment record for the given partial. If there isn't a usable one we start again, keeping whatever
+contiguous data a previous single-stream download left in the partial.
+*/
+func loadSegmentState(partialTarget string, fileSize int64, segmentSize int64) *segmentState {
+	if existing, usable := readSegmentState(partialTarget, fileSize, segmentSize); usable {
+		log.Printf("INFO DownloadManager.loadSegmentState resuming segmented download %s, %d bytes already done", partialTarget, existing.bytesDone())
+		return existing
+	}
+	if _, statErr := os.Stat(segmentsPath(partialTarget)); statErr == nil {
+		log.Printf("WARN DownloadManager.loadSegmentState segment record for %s does not match, starting again", partialTarget)
+		os.Remove(partialTarget)
+		os.Remove(segmentsPath(partialTarget))
+	}
+
+	if info, statErr := os.Stat(partialTarget); statErr == nil && info.Size() <= fileSize {
+		state := newSegmentStateFromPartial(fileSize, segmentSize, info.Size())
+		if done := state.bytesDone(); done > 0 {
+			log.Printf("INFO DownloadManager.loadSegmentState keeping the first %d bytes of %s from a previous download", done, partialTarget)
+		}
+		return state
+	}
+	return newSegmentState(fileSize, segmentSize)
+}
+
+/**
+writes out the segment record. Must not be called concurrently for the same partial.
+*/
+func (s *segmentState) save(partialTarget string) error {
+	content, marshalErr := json.Marshal(s)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	tempName := segmentsPath(partialTarget) + ".tmp"
+	if writeErr := ioutil.WriteFile(tempName, content, 0644); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tempName, segmentsPath(partialTarget))
+}
+
+/**
+removes a partial download and its segment record, if they exist
+*/
+func removeSegmented(partialTarget string) {
+	os.Remove(partialTarget)
+	os.Remove(segmentsPath(partialTarget))
+}
+
+/**
+lets io.Copy write into the middle of a file
+*/
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+/**
+downloads the given url to partialTarget as a number of byte-range segments fetched at once by `streams` goroutines.
+Each segment is retried on its own according to retryPolicy, so a segment failure is not worth retrying again as a
+whole. The segments that are done are recorded so that an interrupted download can be resumed. Once everything is there the whole file is checked against `checksum`, if we have one.
+returns RangesNotSupported if the server won't do byte ranges, in which case the caller should use doDownload instead.
+Otherwise returns a boolean indicating whether the operation should be retried and an error if it failed
+*/
+func doSegmentedDownload(ctx context.Context, client *http.Client, partialTarget string, downloadUrl string, expectedSize int64, segmentSize int64, streams int, checksum *expectedChecksum, progress *FileProgress, limiter *BandwidthLimiter, retryPolicy communicator.RetryPolicy) (bool, error) {
+	state := loadSegmentState(partialTarget, expectedSize, segmentSize)
+	file, openErr := os.OpenFile(partialTarget, os.O_RDWR|os.O_CREATE, 0644)
+	if openErr != nil {
+		log.Printf("ERROR DownloadManager.doSegmentedDownload could not open target file %s: %s", partialTarget, openErr)
+		return false, openErr
+	}
+	defer file.Close()
+	if truncErr := file.Truncate(expectedSize); truncErr != nil {
+		log.Printf("ERROR DownloadManager.doSegmentedDownload could not allocate %s: %s", partialTarget, truncErr)
+		return false, truncErr
+	}
+	if saveErr := state.save(partialTarget); saveErr != nil {
+		log.Printf("ERROR DownloadManager.doSegmentedDownload could not write segment record for %s: %s", partialTarget, saveErr)
+		return false, saveErr
+	}
+	progress.Set(state.bytesDone())
+
+	segmentCtx, cancelSegments := context.WithCancel(ctx)
+	defer cancelSegments()
+
+	pending := make(chan int, len(state.Done))
+	for i, done := range state.Done {
+		if !done {
+			pending <- i
+		}
+	}
+	close(pending)
+
+	var stateMutex sync.Mutex
+	var errMutex sync.Mutex
+	var firstErr error
+	firstShouldRetry := false
+	failed := func(shouldRetry bool, err error) {
+		errMutex.Lock()
+		if firstErr == nil {
+			firstErr = err
+			firstShouldRetry = shouldRetry
+		}
+		errMutex.Unlock()
+		cancelSegments()
+	}
+
+	waitGroup := &sync.WaitGroup{}
+	waitGroup.Add(streams)
+	for i := 0; i < streams; i += 1 {
+		go func() {
+			defer waitGroup.Done()
+			for index := range pending {
+				if segmentCtx.Err() != nil {
+					return
+				}
+				start, end := state.bounds(index)
+				if shouldRetry, segErr := downloadSegment(segmentCtx, client, file, downloadUrl, start, end, progress, limiter, retryPolicy); segErr != nil {
+					failed(shouldRetry, segErr)
+					return
+				}
+				//the data has to be on disk before we record that it's there
+				if syncErr := file.Sync(); syncErr != nil {
+					failed(false, syncErr)
+					return
+				}
+				stateMutex.Lock()
+				state.Done[index] = true
+				saveErr := state.save(partialTarget)
+				stateMutex.Unlock()
+				if saveErr != nil {
+					log.Printf("WARN DownloadManager.doSegmentedDownload could not update segment record for %s: %s", partialTarget, saveErr)
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	if firstErr == RangesNotSupported {
+		log.Printf("INFO DownloadManager.doSegmentedDownload server does not support byte ranges for %s, downloading it as a single stream", partialTarget)
+		file.Close()
+		removeSegmented(partialTarget)
+		return false, RangesNotSupported
+	} else if ctx.Err() != nil {
+		return false, ctx.Err()
+	} else if firstErr != nil {
+		//keep the segments that completed, the next attempt will pick up from there
+		log.Printf("ERROR DownloadManager.doSegmentedDownload download of %s failed: %s", partialTarget, firstErr)
+		return firstShouldRetry, firstErr
+	}
+
+	if syncErr := file.Sync(); syncErr != nil {
+		log.Printf("ERROR DownloadManager.doSegmentedDownload could not flush %s to disk: %s", partialTarget, syncErr)
+		return true, syncErr
+	}
+	if checksum != nil {
+		hasher := checksum.newHash()
+		if hashErr := hashExistingContent(hasher, partialTarget, expectedSize); hashErr != nil {
+			log.Printf("ERROR DownloadManager.doSegmentedDownload could not read back %s: %s", partialTarget, hashErr)
+			return false, hashErr
+		}
+		if !checksum.matches(hasher) {
+			log.Printf("ERROR DownloadManager.doSegmentedDownload %s failed checksum verification, expected %s got %x. Discarding it.", partialTarget, checksum, hasher.Sum(nil))
+			file.Close()
+			removeSegmented(partialTarget)
+			return true, ChecksumMismatch
+		}
+	}
+	os.Remove(segmentsPath(partialTarget))
+	return false, nil
+}
+
+/**
+fetches bytes start to end (inclusive) of the url into the same place in the file, retrying on recoverable errors and
+carrying on from where the last attempt got to.
+returns whether it is worth trying the whole download again, which it isn't once this has used up its own attempts,
+and an error if it failed
+*/
+func downloadSegment(ctx context.Context, client *http.Client, file *os.File, downloadUrl string, start int64, end int64, progress *FileProgress, limiter *BandwidthLimiter, retryPolicy communicator.RetryPolicy) (bool, error) {
+	offset := start
+	attempts := 0
+	for {
+		written, shouldRetry, err := fetchRange(ctx, client, file, downloadUrl, offset, end, progress, limiter)
+		offset += written
+		if err == nil {
+			return false, nil
+		} else if !shouldRetry || ctx.Err() != nil || isDiskFull(err) {
+			return false, err
+		}
+		attempts += 1
+		if attempts >= retryPolicy.MaxAttempts {
+			return false, fmt.Errorf("gave up on bytes %d-%d after %d attempts: %w", start, end, attempts, err)
+		}
+		delay := retryPolicy.Delay(attempts, retryAfterFor(err))
+		log.Printf("WARN DownloadManager.downloadSegment bytes %d-%d of %s: %s, retrying in %s...", offset, end, file.Name(), err, delay.Round(time.Millisecond))
+		if sleepErr := communicator.SleepContext(ctx, delay); sleepErr != nil {
+			return false, sleepErr
+		}
+	}
+}
+
+/**
+makes a single request for bytes start to end (inclusive) and writes them into the file.
+returns the number of bytes written, whether the request should be retried and an error if it failed
+*/
+func fetchRange(ctx context.Context, client *http.Client, file *os.File, downloadUrl string, start int64, end int64, progress *FileProgress, limiter *BandwidthLimiter) (int64, bool, error) {
+	req, reqErr := http.NewRequestWithContext(ctx, "GET", downloadUrl, nil)
+	if reqErr != nil {
+		return 0, false, reqErr
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	response, dlErr := client.Do(req)
+	if dlErr != nil {
+		return 0, communicator.IsRetryableError(dlErr), dlErr
+	}
+	defer response.Body.Close()
+	if retryErr := communicator.RetryableResponse(response); retryErr != nil {
+		return 0, true, retryErr
+	}
+
+	switch response.StatusCode {
+	case 206:
+		rangeStart, rangeErr := parseContentRangeStart(response.Header.Get("Content-Range"))
+		if rangeErr != nil || rangeStart != start {
+			return 0, true, fmt.Errorf("server sent an unexpected range '%s'", response.Header.Get("Content-Range"))
+		}
+		expected := end - start + 1
+		written, copyErr := io.Copy(&offsetWriter{file: file, offset: start}, limiter.WrapReader(ctx, progress.WrapReader(io.LimitReader(response.Body, expected))))
+		if copyErr != nil {
+			return written, true, copyErr
+		}
+		if written < expected {
+			return written, true, ShortDownload
+		}
+		return written, false, nil
+	case 200:
+		return 0, false, RangesNotSupported
+	case 404:
+		return 0, false, errors.New("download not found")
+	case 403:
+		log.Printf("ERROR DownloadManager.fetchRange server responded permission denied, maybe token expired? Try re-starting the download from your browser")
+		return 0, false, errors.New("server permission denied")
+	default:
+		errorContent, _ := ioutil.ReadAll(response.Body)
+		return 0, false, fmt.Errorf("server returned %d: %s", response.StatusCode, string(errorContent))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"github.com/guardian/autopull/downloadmanager"
+	"io"
+	"text/tabwriter"
+)
+
+type DryRunEntry struct {
+	EntryId       string `json:"entryId"`
+	Path          string `json:"path"`
+	Size          int64  `json:"size"`
+	LocalPath     string `json:"localPath,omitempty"`
+	Renamed       bool   `json:"renamed,omitempty"`
+	Action        string `json:"action"`
+	BytesNeeded   int64  `json:"bytesNeeded"`
+	RestoreStatus string `json:"restoreStatus,omitempty"`
+	Available     bool   `json:"available"`
+	Error         string `json:"error,omitempty"`
+}
+
+/**
+what a download run would do, as shown by --dry-run
+*/
+type DryRunReport struct {
+	Lightbox       communicator.LightboxEntry `json:"lightbox"`
+	RetrievalToken string                     `json:"retrievalToken"`
+	Entries        []DryRunEntry              `json:"entries"`
+	TotalBytes     int64                      `json:"totalBytes"`
+	BytesNeeded    int64                      `json:"bytesNeeded"`
+	FreeSpace      int64                      `json:"freeSpace,omitempty"` //zero if it could not be found
+	NotRestored    int                        `json:"notRestored"`
+	Filtered       int                        `json:"filtered"`
+}
+
+func NewDryRunReport(downloadInfo *communicator.BulkDownloadInitiateResponse, plans []*downloadmanager.EntryPlan, excluded []*downloadmanager.DownloadResult, freeSpace int64) *DryRunReport {
+	report := &DryRunReport{
+		Lightbox:       downloadInfo.Metadata,
+		RetrievalToken: downloadInfo.RetrievalToken,
+		Entries:        make([]DryRunEntry, 0, len(plans)+len(excluded)),
+		FreeSpace:      freeSpace,
+	}
+	for _, plan := range plans {
+		entry := DryRunEntry{
+			EntryId:       plan.Entry.EntryId,
+			Path:          plan.Entry.Path,
+			Size:          plan.Entry.FileSize,
+			LocalPath:     plan.LocalPath,
+			Renamed:       plan.Renamed,
+			Action:        string(plan.Action),
+			BytesNeeded:   plan.BytesNeeded,
+			RestoreStatus: plan.RestoreStatus,
+			Available:     plan.Available(),
+		}
+		if plan.Error != nil {
+			entry.Error = plan.Error.Error()
+		}
+		report.TotalBytes += plan.Entry.FileSize
+		report.BytesNeeded += plan.BytesNeeded
+		if plan.Action.Downloads() && plan.RestoreStatus != "" && !plan.Available() {
+			report.NotRestored += 1
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	for _, result := range excluded {
+		entry := DryRunEntry{
+			EntryId: result.Entry.EntryId,
+			Path:    result.Entry.Path,
+			Size:    result.Entry.FileSize,
+			Action:  result.Status.String(),
+		}
+		if result.Error != nil {
+			entry.Error = result.Error.Error()
+		}
+		report.Entries = append(report.Entries, entry)
+		report.Filtered += 1
+	}
+	return report
+}
+
+/**
+describes the restore status of an entry for the table
+*/
+func restoreDescription(entry *DryRunEntry) string {
+	switch {
+	case entry.RestoreStatus == "":
+		return "-"
+	case entry.Available:
+		return "available"
+	case entry.RestoreStatus == "RS_PENDING" || entry.RestoreStatus == "RS_UNDERWAY":
+		return "restoring"
+	case entry.RestoreStatus == "RS_ERROR" || entry.RestoreStatus == "RS_EXPIRED":
+		return "needs restore"
+	default:
+		return entry.RestoreStatus
+	}
+}
+
+func (r *DryRunReport) WriteTable(output io.Writer) {
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PATH\tSIZE\tLOCAL PATH\tACTION\tRESTORE\tNOTES")
+	for i := range r.Entries {
+		entry := &r.Entries[i]
+		notes := entry.Error
+		if notes == "" && entry.Renamed {
+			notes = "renamed"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Path,
+			FormatByteSize(entry.Size, 0),
+			entry.LocalPath,
+			entry.Action,
+			restoreDescription(entry),
+			notes)
+	}
+	writer.Flush()
+
+	fmt.Fprintf(output, "\n%d files totalling %s", len(r.Entries)-r.Filtered, FormatByteSize(r.TotalBytes, 0))
+	if r.Filtered > 0 {
+		fmt.Fprintf(output, " and %d left out by filters", r.Filtered)
+	}
+	fmt.Fprintf(output, ". %s of disk space needed", FormatByteSize(r.BytesNeeded, 0))
+	if r.FreeSpace > 0 {
+		fmt.Fprintf(output, ", %s free", FormatByteSize(r.FreeSpace, 0))
+	}
+	fmt.Fprintln(output, ".")
+	if r.FreeSpace > 0 && r.BytesNeeded > r.FreeSpace {
+		fmt.Fprintf(output, "WARNING: these files will not fit in the download folder.\n")
+	}
+	if r.NotRestored > 0 {
+		fmt.Fprintf(output, "%d files are not restored from the archive yet.\n", r.NotRestored)
+	}
+}
+
+func (r *DryRunReport) WriteJson(output io.Writer) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
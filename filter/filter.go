@@ -0,0 +1,196 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"regexp"
+	"strings"
+)
+
+/**
+the include/exclude and size settings, as given in the config file, on the commandline or in the custom uri
+*/
+type Rules struct {
+	Include []string //glob patterns, or regular expressions prefixed with "re:". If any are given, entries must match one
+	Exclude []string //entries matching any of these are left out
+	MinSize int64    //entries smaller than this are left out. Zero means no minimum
+	MaxSize int64    //entries larger than this are left out. Zero means no maximum
+}
+
+type pattern struct {
+	source  string
+	matcher *regexp.Regexp
+}
+
+/**
+decides which lightbox entries to download
+*/
+type Filter struct {
+	include []pattern
+	exclude []pattern
+	minSize int64
+	maxSize int64
+}
+
+/**
+an entry that has been left out, and why
+*/
+type Excluded struct {
+	Entry  communicator.ArchiveEntryDownloadSynopsis
+	Reason string
+}
+
+/**
+converts a glob pattern into a regular expression. `*` and `?` don't match a /, `**` matches anything including /
+and [...] character classes are passed through. Patterns without a / are matched against the file name, patterns with
+one against the whole path. Matching ignores case, so *.mov also matches CLIP.MOV
+*/
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var builder strings.Builder
+	builder.WriteString("(?i)")
+	if strings.Contains(glob, "/") {
+		builder.WriteString("^")
+		glob = strings.TrimLeft(glob, "/")
+	} else {
+		builder.WriteString("(^|/)")
+	}
+
+	for i := 0; i < len(glob); i += 1 {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				if i+2 < len(glob) && glob[i+2] == '/' {
+					//"**/" can match no directories at all
+					builder.WriteString("(.*/)?")
+					i += 2
+				} else {
+					builder.WriteString(".*")
+					i += 1
+				}
+			} else {
+				builder.WriteString("[^/]*")
+			}
+		case '?':
+			builder.WriteString("[^/]")
+		case '[':
+			closing := strings.Index(glob[i:], "]")
+			if closing < 0 {
+				return nil, fmt.Errorf("unterminated [ in '%s'", glob)
+			}
+			class := glob[i+1 : i+closing]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			builder.WriteString("[" + class + "]")
+			i += closing
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	builder.WriteString("$")
+	return regexp.Compile(builder.String())
+}
+
+func newPattern(source string) (pattern, error) {
+	var matcher *regexp.Regexp
+	var err error
+	if strings.HasPrefix(source, "re:") {
+		matcher, err = regexp.Compile(strings.TrimPrefix(source, "re:"))
+	} else {
+		matcher, err = globToRegexp(source)
+	}
+	if err != nil {
+		return pattern{}, fmt.Errorf("invalid pattern '%s': %s", source, err)
+	}
+	return pattern{source: source, matcher: matcher}, nil
+}
+
+func newPatterns(sources []string) ([]pattern, error) {
+	rtn := make([]pattern, 0, len(sources))
+	for _, source := range sources {
+		if source == "" {
+			continue
+		}
+		p, err := newPattern(source)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, p)
+	}
+	return rtn, nil
+}
+
+func New(rules Rules) (*Filter, error) {
+	include, includeErr := newPatterns(rules.Include)
+	if includeErr != nil {
+		return nil, includeErr
+	}
+	exclude, excludeErr := newPatterns(rules.Exclude)
+	if excludeErr != nil {
+		return nil, excludeErr
+	}
+	if rules.MaxSize > 0 && rules.MinSize > rules.MaxSize {
+		return nil, fmt.Errorf("minimum size %d is larger than the maximum size %d", rules.MinSize, rules.MaxSize)
+	}
+	return &Filter{
+		include: include,
+		exclude: exclude,
+		minSize: rules.MinSize,
+		maxSize: rules.MaxSize,
+	}, nil
+}
+
+/**
+returns true if there are any rules at all
+*/
+func (f *Filter) IsActive() bool {
+	return len(f.include) > 0 || len(f.exclude) > 0 || f.minSize > 0 || f.maxSize > 0
+}
+
+/**
+returns an empty string if the entry should be downloaded, or the reason it is left out
+*/
+func (f *Filter) Check(entry *communicator.ArchiveEntryDownloadSynopsis) string {
+	//server paths usually start with a /, but patterns are relative to the top of the download, like the local paths
+	entryPath := strings.TrimLeft(strings.ReplaceAll(entry.Path, "\\", "/"), "/")
+	if len(f.include) > 0 {
+		included := false
+		for _, p := range f.include {
+			if p.matcher.MatchString(entryPath) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "not matched by any include pattern"
+		}
+	}
+	for _, p := range f.exclude {
+		if p.matcher.MatchString(entryPath) {
+			return fmt.Sprintf("matched exclude pattern '%s'", p.source)
+		}
+	}
+	if f.minSize > 0 && entry.FileSize < f.minSize {
+		return "smaller than the minimum size"
+	}
+	if f.maxSize > 0 && entry.FileSize > f.maxSize {
+		return "larger than the maximum size"
+	}
+	return ""
+}
+
+/**
+splits the entries into the ones to download and the ones that are left out
+*/
+func (f *Filter) Apply(entries []communicator.ArchiveEntryDownloadSynopsis) ([]communicator.ArchiveEntryDownloadSynopsis, []Excluded) {
+	kept := make([]communicator.ArchiveEntryDownloadSynopsis, 0, len(entries))
+	excluded := make([]Excluded, 0)
+	for _, entry := range entries {
+		if reason := f.Check(&entry); reason != "" {
+			excluded = append(excluded, Excluded{Entry: entry, Reason: reason})
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, excluded
+}
@@ -0,0 +1,98 @@
+package filter
+
+import (
+	"github.com/guardian/autopull/communicator"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matches bool
+	}{
+		{"*.mov", "clip.mov", true},
+		{"*.mov", "card1/CLIP.MOV", true},
+		{"*.mov", "clip.mxf", false},
+		{"card?/*.mxf", "card1/a.mxf", true},
+		{"card?/*.mxf", "card1/sub/a.mxf", false},
+		{"card?/*.mxf", "other/card1/a.mxf", false},
+		{"card1/**", "card1/sub/a.mxf", true},
+		{"**/proxy/*", "a/b/proxy/c.mp4", true},
+		{"**/proxy/*", "proxy/c.mp4", true},
+		{"[ab]*.wav", "a1.wav", true},
+		{"[!ab]*.wav", "a1.wav", false},
+		{"file(1).txt", "file(1).txt", true},
+	}
+	for _, test := range tests {
+		matcher, err := globToRegexp(test.glob)
+		if err != nil {
+			t.Errorf("globToRegexp(%q) returned unexpected error %s", test.glob, err)
+			continue
+		}
+		if matcher.MatchString(test.path) != test.matches {
+			t.Errorf("%q matching %q should have been %t", test.glob, test.path, test.matches)
+		}
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	f, err := New(Rules{
+		Include: []string{"*.mov", "re:\\.mxf$"},
+		Exclude: []string{"**/proxy/**"},
+		MinSize: 100,
+		MaxSize: 1000,
+	})
+	if err != nil {
+		t.Fatalf("New returned unexpected error %s", err)
+	}
+
+	entries := []communicator.ArchiveEntryDownloadSynopsis{
+		{Path: "a/clip.mov", FileSize: 500},
+		{Path: "a/clip.mxf", FileSize: 500},
+		{Path: "a/clip.wav", FileSize: 500},
+		{Path: "a/proxy/clip.mov", FileSize: 500},
+		{Path: "a/tiny.mov", FileSize: 10},
+		{Path: "a/huge.mov", FileSize: 10000},
+		{Path: "a\\windows.mov", FileSize: 500},
+	}
+	kept, excluded := f.Apply(entries)
+	if len(kept) != 3 || kept[0].Path != "a/clip.mov" || kept[1].Path != "a/clip.mxf" || kept[2].Path != "a\\windows.mov" {
+		t.Errorf("unexpected entries kept: %v", kept)
+	}
+	if len(excluded) != 4 {
+		t.Errorf("expected 4 entries to be excluded, got %v", excluded)
+	}
+
+	if _, err := New(Rules{Include: []string{"re:("}}); err == nil {
+		t.Errorf("New should have rejected an invalid regex")
+	}
+	if _, err := New(Rules{MinSize: 10, MaxSize: 5}); err == nil {
+		t.Errorf("New should have rejected a minimum size larger than the maximum")
+	}
+}
+
+func TestFilterLeadingSlashPaths(t *testing.T) {
+	tests := []struct {
+		include string
+		path    string
+		kept    bool
+	}{
+		{"/card1/*.mov", "/card1/a.mov", true},
+		{"card1/**", "/card1/a.mov", true},
+		{"card1/*.mov", "//card1/a.mov", true},
+		{"*.mov", "/card1/a.mov", true},
+		{"/card1/*.mov", "/card2/a.mov", false},
+		{"card1/**", "/other/card1/a.mov", false},
+	}
+	for _, test := range tests {
+		f, err := New(Rules{Include: []string{test.include}})
+		if err != nil {
+			t.Fatalf("New returned unexpected error %s", err)
+		}
+		reason := f.Check(&communicator.ArchiveEntryDownloadSynopsis{Path: test.path})
+		if (reason == "") != test.kept {
+			t.Errorf("include %q with path %q: expected kept %t, got reason '%s'", test.include, test.path, test.kept, reason)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/guardian/autopull/config"
+	"github.com/guardian/autopull/downloadmanager"
+	"github.com/guardian/autopull/filter"
+	"net/url"
+	"strings"
+)
+
+/**
+a commandline flag that can be given more than once
+*/
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func parseSizeSetting(name string, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := config.ParseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return size, nil
+}
+
+/**
+puts together the filter rules from the config file, the commandline and the custom uri. Include and exclude patterns
+from all three are used; for the sizes, the uri takes precedence over the commandline, which takes precedence over the
+config file
+*/
+func buildFilter(configuration *config.Configuration, includes stringList, excludes stringList, minSize string, maxSize string, query url.Values) (*filter.Filter, error) {
+	rules := filter.Rules{
+		Include: append(append(append([]string{}, configuration.Include...), includes...), query["include"]...),
+		Exclude: append(append(append([]string{}, configuration.Exclude...), excludes...), query["exclude"]...),
+	}
+
+	minSetting := configuration.MinSize
+	if minSize != "" {
+		minSetting = minSize
+	}
+	if query.Get("min_size") != "" {
+		minSetting = query.Get("min_size")
+	}
+	maxSetting := configuration.MaxSize
+	if maxSize != "" {
+		maxSetting = maxSize
+	}
+	if query.Get("max_size") != "" {
+		maxSetting = query.Get("max_size")
+	}
+
+	var sizeErr error
+	if rules.MinSize, sizeErr = parseSizeSetting("min_size", minSetting); sizeErr != nil {
+		return nil, sizeErr
+	}
+	if rules.MaxSize, sizeErr = parseSizeSetting("max_size", maxSetting); sizeErr != nil {
+		return nil, sizeErr
+	}
+	return filter.New(rules)
+}
+
+/**
+makes results for the entries that were left out by the filters, so that they show up in the summary and report
+*/
+func filteredResults(excluded []filter.Excluded) []*downloadmanager.DownloadResult {
+	rtn := make([]*downloadmanager.DownloadResult, len(excluded))
+	for i, ex := range excluded {
+		rtn[i] = &downloadmanager.DownloadResult{
+			Entry:  ex.Entry,
+			Status: downloadmanager.StatusFiltered,
+			Error:  errors.New(ex.Reason),
+		}
+	}
+	return rtn
+}
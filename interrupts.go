@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+/**
+InterruptHandler deals with Ctrl-C and SIGTERM. The first one asks the run to stop gracefully, finishing off the
+downloads that are in progress; the second one cancels everything immediately.
+*/
+type InterruptHandler struct {
+	mutex       sync.Mutex
+	count       int
+	cancel      context.CancelFunc
+	gracefulFn  func()
+	signalsChan chan os.Signal
+}
+
+/**
+starts listening for interrupts. Until SetGracefulStop is called, the first interrupt cancels the given context
+*/
+func NewInterruptHandler(cancel context.CancelFunc) *InterruptHandler {
+	h := &InterruptHandler{
+		cancel:      cancel,
+		signalsChan: make(chan os.Signal, 2),
+	}
+	signal.Notify(h.signalsChan, os.Interrupt, syscall.SIGTERM)
+	go h.run()
+	return h
+}
+
+/**
+stops listening for interrupts, so that they go back to ending the program straight away
+*/
+func (h *InterruptHandler) Stop() {
+	signal.Stop(h.signalsChan)
+	close(h.signalsChan)
+}
+
+/**
+sets the function to call to stop gracefully on the first interrupt
+*/
+func (h *InterruptHandler) SetGracefulStop(fn func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.gracefulFn = fn
+}
+
+/**
+returns true if we have been interrupted
+*/
+func (h *InterruptHandler) Interrupted() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count > 0
+}
+
+func (h *InterruptHandler) run() {
+	for sig := range h.signalsChan {
+		h.mutex.Lock()
+		h.count += 1
+		count := h.count
+		gracefulFn := h.gracefulFn
+		h.mutex.Unlock()
+
+		if count == 1 && gracefulFn != nil {
+			log.Printf("WARN main received %s, finishing the downloads in progress. Interrupt again to stop immediately.", sig)
+			gracefulFn()
+		} else {
+			log.Printf("WARN main received %s, stopping immediately. Partial downloads are kept and will be resumed next time.", sig)
+			if gracefulFn != nil {
+				gracefulFn()
+			}
+			h.cancel()
+		}
+	}
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/guardian/autopull/communicator"
 	"github.com/guardian/autopull/config"
 	"github.com/guardian/autopull/downloadmanager"
+	"github.com/guardian/autopull/filter"
+	"github.com/guardian/autopull/state"
 	"log"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
+//reported in the log and in the User-Agent of requests. Can be set when building with -ldflags "-X main.Version=..."
+var Version = "0.1"
+
 func enqueueDownloads(entriesListPtr *[]communicator.ArchiveEntryDownloadSynopsis, mgr downloadmanager.DownloadManager) {
 	for _, ent := range *entriesListPtr {
 		mgr.Enqueue(ent)
@@ -22,6 +30,8 @@ func enqueueDownloads(entriesListPtr *[]communicator.ArchiveEntryDownloadSynopsi
 
 func ExitPause(noWait bool, exitCode int) {
 	if !noWait {
+		//Ctrl-C at the prompt should close the program, even if we were handling it ourselves before
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
 		print("Press ENTER to close...")
 		fmt.Scanln()
 	}
@@ -29,7 +39,7 @@ func ExitPause(noWait bool, exitCode int) {
 }
 
 func main() {
-	log.Printf("autopull v0.1 Andy Gallagher. https://github.com/guardian/autopull")
+	log.Printf("autopull v%s Andy Gallagher. https://github.com/guardian/autopull", Version)
 	exePath, pathErr := os.Executable()
 	var myPath string
 	if pathErr != nil {
@@ -41,6 +51,17 @@ func main() {
 
 	configFilePtr := flag.String("config", filepath.Join(myPath, "autopull.yaml"), "Path to a yaml config file")
 	downloadPathPtr := flag.String("to", "", "Download path, overriding the default value in the config file")
+	reportPathPtr := flag.String("report", "", "Write a JSON report of the download run to this path, overriding the value in the config file")
+	maxBandwidthPtr := flag.String("max-bandwidth", "", "Limit the total download rate, e.g. 50MiB/s, overriding the value in the config file")
+	var includePatterns stringList
+	var excludePatterns stringList
+	flag.Var(&includePatterns, "include", "Only download entries matching this glob pattern, or regular expression prefixed with re:. Can be given more than once")
+	flag.Var(&excludePatterns, "exclude", "Don't download entries matching this glob pattern, or regular expression prefixed with re:. Can be given more than once")
+	minSizePtr := flag.String("min-size", "", "Don't download entries smaller than this, e.g. 10MB")
+	maxSizePtr := flag.String("max-size", "", "Don't download entries larger than this, e.g. 50GB")
+	dryRunPtr := flag.Bool("dry-run", false, "Show what would be downloaded and where, without downloading anything")
+	outputPtr := flag.String("output", "table", "Format for --dry-run output, table or json")
+	statusPtr := flag.Bool("status", false, "Show what is still outstanding for each lightbox in the download folder, then exit")
 	flag.Parse()
 
 	if configFilePtr == nil {
@@ -60,6 +81,32 @@ func main() {
 		ExitPause(nowait, 3)
 	}
 
+	var downloadPath string
+	if downloadPathPtr != nil && *downloadPathPtr != "" {
+		downloadPath = *downloadPathPtr
+	} else if configuration.DownloadPath != "" {
+		downloadPath = configuration.DownloadPath
+	} else {
+		log.Printf("ERROR main no download path has been set. Try setting `download_path: yourpath` in the settings file")
+		ExitPause(configuration.NoWait, 7)
+	}
+
+	stateStore, stateErr := state.Open(downloadPath)
+	if stateErr != nil {
+		log.Printf("ERROR main could not read download state from %s: %s", downloadPath, stateErr)
+		ExitPause(configuration.NoWait, 7)
+	}
+
+	if *outputPtr != "table" && *outputPtr != "json" {
+		log.Printf("ERROR main --output must be table or json")
+		ExitPause(configuration.NoWait, 2)
+	}
+
+	if *statusPtr {
+		printStatus(os.Stdout, stateStore)
+		ExitPause(configuration.NoWait, 0)
+	}
+
 	vaultdoorUrl, parseErr := url.Parse(configuration.VaultDoorUri)
 	if parseErr != nil {
 		log.Printf("ERROR main could not parse VaultDoor uri %s: %s", configuration.VaultDoorUri, parseErr)
@@ -72,20 +119,49 @@ func main() {
 		ExitPause(configuration.NoWait, 4)
 	}
 
-	if len(os.Args) < 2 {
+	tlsConfig, tlsErr := communicator.NewTLSConfig(communicator.TLSSettings{
+		CABundle:   configuration.CABundle,
+		ClientCert: configuration.ClientCert,
+		ClientKey:  configuration.ClientKey,
+		MinVersion: configuration.MinTLSVersion,
+	})
+	if tlsErr != nil {
+		log.Printf("ERROR main invalid TLS settings: %s", tlsErr)
+		ExitPause(configuration.NoWait, 3)
+	}
+
+	proxySelector, proxyErr := communicator.NewProxySelector(communicator.ProxySettings{
+		Default:       configuration.Proxy,
+		VaultDoor:     configuration.VaultDoorProxy,
+		ArchiveHunter: configuration.ArchiveHunterProxy,
+		Downloads:     configuration.DownloadProxy,
+		NoProxy:       configuration.NoProxy,
+		Username:      configuration.ProxyUsername,
+		Password:      configuration.ProxyPassword,
+	}, vaultdoorUrl, archivehunterUrl)
+	if proxyErr != nil {
+		log.Printf("ERROR main invalid proxy settings: %s", proxyErr)
+		ExitPause(configuration.NoWait, 3)
+	}
+	if proxySelector != nil {
+		log.Printf("INFO main proxies: %s", proxySelector)
+	}
+
+	if flag.NArg() < 1 {
 		log.Printf("ERROR main You must specify a download token as the first positional argument")
 		ExitPause(configuration.NoWait, 1)
 	}
 
-	if os.Args[1] == "" {
+	tokenArg := flag.Arg(0)
+	if tokenArg == "" {
 		log.Printf("ERROR main You must specify a download or custom uri as the first positional argument")
 		ExitPause(configuration.NoWait, 1)
 	}
 
 	var downloadToken config.DownloadTokenUri
-	if strings.Contains(os.Args[1], ":") {
+	if strings.Contains(tokenArg, ":") {
 		var parseErr error
-		downloadToken, parseErr = config.ParseArchiveHunterUri(os.Args[1])
+		downloadToken, parseErr = config.ParseArchiveHunterUri(tokenArg)
 		if parseErr != nil {
 			log.Printf("ERROR main provided URI was not properly formed: %s", parseErr)
 			ExitPause(configuration.NoWait, 5)
@@ -98,12 +174,18 @@ func main() {
 		downloadToken = config.DownloadTokenUri{
 			Proto:   "archivehunter",
 			Subtype: "vaultdownload",
-			Token:   os.Args[1],
+			Token:   tokenArg,
 		}
 	}
 
 	log.Printf("INFO main Download token is %s", downloadToken)
 
+	entryFilter, filterErr := buildFilter(configuration, includePatterns, excludePatterns, *minSizePtr, *maxSizePtr, downloadToken.Query)
+	if filterErr != nil {
+		log.Printf("ERROR main invalid filter settings: %s", filterErr)
+		ExitPause(configuration.NoWait, 3)
+	}
+
 	var commType communicator.CommunicatorType
 	if downloadToken.ValidateVaultDoor() {
 		commType = communicator.VaultDoor
@@ -111,52 +193,260 @@ func main() {
 		commType = communicator.ArchiveHunter
 	}
 
-	comm := communicator.Communicator{VaultDoorUri: *vaultdoorUrl, ArchiveHunterUri: *archivehunterUrl, Type: commType}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := NewInterruptHandler(cancel)
 
-	downloadInfo, redeemErr := comm.RedeemToken(downloadToken, 1)
+	retryPolicy := communicator.DefaultRetryPolicy
+	if configuration.RetryMaxAttempts > 0 {
+		retryPolicy.MaxAttempts = configuration.RetryMaxAttempts
+	}
+	if configuration.RetryInitialDelay > 0 {
+		retryPolicy.InitialDelay = time.Duration(configuration.RetryInitialDelay) * time.Second
+	}
+	if configuration.RetryMaxDelay > 0 {
+		retryPolicy.MaxDelay = time.Duration(configuration.RetryMaxDelay) * time.Second
+	}
+	if retryPolicy.MaxDelay < retryPolicy.InitialDelay {
+		log.Printf("ERROR main retry_max_delay must not be less than retry_initial_delay")
+		ExitPause(configuration.NoWait, 3)
+	}
+
+	threadCount := configuration.DownloadThreads
+	if threadCount == 0 {
+		threadCount = 5
+	}
+
+	segmentStreams := configuration.SegmentStreams
+	if segmentStreams <= 0 {
+		segmentStreams = 4
+	}
+
+	httpSettings := communicator.DefaultHttpSettings
+	//every thread can have a connection open for each segment of a segmented download
+	httpSettings.PoolSize = threadCount * segmentStreams
+	httpSettings.UserAgent = fmt.Sprintf("autopull/%s", Version)
+	httpSettings.TLSConfig = tlsConfig
+	httpSettings.Proxy = proxySelector
+	if configuration.ConnectTimeout > 0 {
+		httpSettings.ConnectTimeout = time.Duration(configuration.ConnectTimeout) * time.Second
+	}
+	if configuration.TLSHandshakeTimeout > 0 {
+		httpSettings.TLSHandshakeTimeout = time.Duration(configuration.TLSHandshakeTimeout) * time.Second
+	}
+	if configuration.ResponseHeaderTimeout > 0 {
+		httpSettings.ResponseHeaderTimeout = time.Duration(configuration.ResponseHeaderTimeout) * time.Second
+	}
+	if configuration.IdleReadTimeout > 0 {
+		httpSettings.IdleReadTimeout = time.Duration(configuration.IdleReadTimeout) * time.Second
+	}
+
+	comm := communicator.Communicator{
+		VaultDoorUri:     *vaultdoorUrl,
+		ArchiveHunterUri: *archivehunterUrl,
+		Type:             commType,
+		Retry:            retryPolicy,
+		HttpClient:       communicator.NewHttpClient(httpSettings),
+	}
+
+	downloadInfo, redeemErr := comm.RedeemToken(ctx, downloadToken)
 	if redeemErr != nil {
 		log.Printf("ERROR main could not redeem download token: %s", redeemErr)
+		if advice := serverErrorAdvice(redeemErr); advice != "" {
+			fmt.Println(advice)
+		}
 		ExitPause(configuration.NoWait, 5)
 	}
 
 	//spew.Dump(downloadInfo)
 
+	var excludedResults []*downloadmanager.DownloadResult
+	if entryFilter.IsActive() {
+		var excluded []filter.Excluded
+		downloadInfo.Entries, excluded = entryFilter.Apply(downloadInfo.Entries)
+		log.Printf("INFO main filters left out %d of %d entries", len(excluded), len(excluded)+len(downloadInfo.Entries))
+		excludedResults = filteredResults(excluded)
+	}
+
 	totalFiles, totalBytes := downloadInfo.TotalUpEntries()
 	log.Printf("INFO main Will try to download a total of %d files totalling %s", totalFiles, FormatByteSize(totalBytes, 0))
 
-	threadCount := configuration.DownloadThreads
-	if threadCount == 0 {
-		threadCount = 5
-	}
-
 	dlQueueBufferSize := configuration.QueueBufferSize
 	if dlQueueBufferSize == 0 {
 		dlQueueBufferSize = 10
 	}
 
-	var downloadPath string
-	if downloadPathPtr != nil && *downloadPathPtr != "" {
-		downloadPath = *downloadPathPtr
-	} else if configuration.DownloadPath != "" {
-		downloadPath = configuration.DownloadPath
+	restorePollInterval := configuration.RestorePollInterval
+	if restorePollInterval <= 0 {
+		restorePollInterval = 60
+	}
+
+	restorePollMaxInterval := configuration.RestorePollMaxInterval
+	if restorePollMaxInterval <= 0 {
+		restorePollMaxInterval = 900
+	}
+
+	restoreMaxWait := configuration.RestoreMaxWait
+	if restoreMaxWait == 0 {
+		restoreMaxWait = 720
+	} else if restoreMaxWait < 0 {
+		restoreMaxWait = 0
+	}
+
+	var restoreTier communicator.RetrievalTier
+	if configuration.RestoreTier == "" {
+		restoreTier = communicator.TierStandard
+	} else if configuration.RestoreTier != "none" {
+		var tierErr error
+		restoreTier, tierErr = communicator.ParseRetrievalTier(configuration.RestoreTier)
+		if tierErr != nil {
+			log.Printf("ERROR main invalid restore_tier setting: %s", tierErr)
+			ExitPause(configuration.NoWait, 3)
+		}
+	}
+
+	pathMapping, mappingErr := downloadmanager.ParsePathMapping(configuration.FilenameMapping)
+	if mappingErr != nil {
+		log.Printf("ERROR main invalid filename_mapping setting: %s", mappingErr)
+		ExitPause(configuration.NoWait, 3)
+	}
+
+	var conflictPolicy downloadmanager.ConflictPolicy
+	if configuration.ConflictPolicy != "" {
+		var policyErr error
+		conflictPolicy, policyErr = downloadmanager.ParseConflictPolicy(configuration.ConflictPolicy)
+		if policyErr != nil {
+			log.Printf("ERROR main invalid conflict_policy setting: %s", policyErr)
+			ExitPause(configuration.NoWait, 3)
+		}
+	} else if configuration.AllowOverwrite {
+		log.Printf("WARN main allow_overwrite is deprecated, use `conflict_policy: overwrite` instead")
+		conflictPolicy = downloadmanager.ConflictOverwrite
 	} else {
-		log.Printf("ERROR main no download path has been set. Try setting `download_path: yourpath` in the settings file")
-		ExitPause(configuration.NoWait, 7)
+		conflictPolicy = downloadmanager.ConflictSkip
+	}
+
+	var segmentThreshold int64 = 0
+	if configuration.SegmentThreshold != "" {
+		var sizeErr error
+		segmentThreshold, sizeErr = config.ParseByteSize(configuration.SegmentThreshold)
+		if sizeErr != nil {
+			log.Printf("ERROR main invalid segment_threshold setting: %s", sizeErr)
+			ExitPause(configuration.NoWait, 3)
+		}
+	}
+
+	var segmentSize int64 = 64 * 1024 * 1024
+	if configuration.SegmentSize != "" {
+		var sizeErr error
+		segmentSize, sizeErr = config.ParseByteSize(configuration.SegmentSize)
+		if sizeErr != nil || segmentSize <= 0 {
+			log.Printf("ERROR main invalid segment_size setting '%s'", configuration.SegmentSize)
+			ExitPause(configuration.NoWait, 3)
+		}
 	}
 
-	mgr := downloadmanager.NewDownloadManager(&comm, downloadInfo.RetrievalToken, threadCount, dlQueueBufferSize, downloadPath, configuration.AllowOverwrite)
+	diskSpaceCheck := strings.ToLower(configuration.DiskSpaceCheck)
+	if diskSpaceCheck == "" {
+		diskSpaceCheck = "abort"
+	} else if diskSpaceCheck != "abort" && diskSpaceCheck != "warn" && diskSpaceCheck != "off" {
+		log.Printf("ERROR main invalid disk_space_check setting '%s', expected abort, warn or off", configuration.DiskSpaceCheck)
+		ExitPause(configuration.NoWait, 3)
+	}
 
-	initErr := mgr.Init()
+	bandwidthControl, bandwidthErr := NewBandwidthControl(*configFilePtr, *maxBandwidthPtr, configuration)
+	if bandwidthErr != nil {
+		log.Printf("ERROR main invalid bandwidth settings: %s", bandwidthErr)
+		ExitPause(configuration.NoWait, 3)
+	}
+
+	if !*dryRunPtr {
+		if recordErr := stateStore.RecordManifest(downloadInfo); recordErr != nil {
+			log.Printf("WARN main could not write download state to %s: %s", stateStore.Path(), recordErr)
+		}
+	}
+
+	progressTracker := downloadmanager.NewProgressTracker(int(totalFiles), totalBytes, threadCount)
+
+	mgr := downloadmanager.NewDownloadManager(&comm, downloadInfo.RetrievalToken, downloadmanager.Options{
+		ThreadCount:            threadCount,
+		BufferSize:             dlQueueBufferSize,
+		BasePath:               downloadPath,
+		ConflictPolicy:         conflictPolicy,
+		RestorePollInterval:    time.Duration(restorePollInterval) * time.Second,
+		RestorePollMaxInterval: time.Duration(restorePollMaxInterval) * time.Second,
+		RestoreMaxWait:         time.Duration(restoreMaxWait) * time.Minute,
+		RestoreTier:            restoreTier,
+		Progress:               progressTracker,
+		PathMapping:            pathMapping,
+		State:                  stateStore,
+		SegmentThreshold:       segmentThreshold,
+		SegmentSize:            segmentSize,
+		SegmentStreams:         segmentStreams,
+		Bandwidth:              bandwidthControl.Limiter(),
+	})
+
+	if *dryRunPtr {
+		var freeSpace int64 = 0
+		if space, spaceErr := downloadmanager.FreeSpaceFor(downloadPath); spaceErr == nil {
+			freeSpace = int64(space)
+		}
+		report := NewDryRunReport(downloadInfo, mgr.Plan(ctx, downloadInfo.Entries), excludedResults, freeSpace)
+		if *outputPtr == "json" {
+			if writeErr := report.WriteJson(os.Stdout); writeErr != nil {
+				log.Printf("ERROR main could not write dry run output: %s", writeErr)
+			}
+		} else {
+			report.WriteTable(os.Stdout)
+		}
+		ExitPause(configuration.NoWait, 0)
+	}
+
+	if !checkDiskSpace(diskSpaceCheck, downloadPath, mgr.SpaceNeeded(downloadInfo.Entries)) {
+		ExitPause(configuration.NoWait, ExitInsufficientSpace)
+	}
+
+	interrupts.SetGracefulStop(mgr.Stop)
+	if interrupts.Interrupted() || ctx.Err() != nil {
+		//nothing has been started, so there is nothing to finish off
+		log.Printf("WARN main interrupted before any downloads were started")
+		interrupts.Stop()
+		ExitPause(configuration.NoWait, ExitInterrupted)
+	}
+	initErr := mgr.Init(ctx)
 	if initErr != nil {
 		log.Printf("ERROR main Could not initialise download manager: %s", initErr)
 		ExitPause(configuration.NoWait, 6)
 	}
 
-	time.Sleep(1 * time.Second)
+	progressDisplay := NewProgressDisplay(progressTracker, os.Stdout)
+	progressDisplay.Start()
+	bandwidthControl.Start()
+
+	startTime := time.Now()
 	enqueueDownloads(&downloadInfo.Entries, mgr)
 
 	log.Printf("DEBUG main enqueued items, waiting for download threads")
-	time.Sleep(5 * time.Second)
-	mgr.Shutdown(true)
-	ExitPause(configuration.NoWait, 0)
+	results := append(mgr.CompleteAndWait(), excludedResults...)
+	interrupts.Stop()
+	bandwidthControl.Stop()
+	progressDisplay.Stop()
+	printSummary(os.Stdout, results)
+	if interrupts.Interrupted() {
+		log.Printf("WARN main the run was interrupted. Run the same link again to pick up where it left off.")
+	}
+
+	reportPath := configuration.ReportPath
+	if reportPathPtr != nil && *reportPathPtr != "" {
+		reportPath = *reportPathPtr
+	}
+	if reportPath != "" {
+		report := NewRunReport(downloadInfo, startTime, time.Now(), results)
+		if reportErr := report.WriteToFile(reportPath); reportErr != nil {
+			log.Printf("ERROR main could not write report to %s: %s", reportPath, reportErr)
+		} else {
+			log.Printf("INFO main wrote report to %s", reportPath)
+		}
+	}
+	ExitPause(configuration.NoWait, exitCodeForResults(results))
 }
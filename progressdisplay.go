@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"github.com/guardian/autopull/downloadmanager"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//how many seconds of history to use when working out the current transfer rate
+const speedWindow = 10
+
+/**
+the width to assume when we can't ask the terminal, from $COLUMNS if it is set
+*/
+func defaultTerminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+/**
+ProgressDisplay shows how the run is going. On a terminal it redraws a block of status lines at the bottom of the
+screen, with log output scrolling above it. Otherwise it writes a progress line to the log every so often.
+*/
+type ProgressDisplay struct {
+	tracker    *downloadmanager.ProgressTracker
+	output     *os.File
+	logOutput  *os.File //where the log goes. Only routed through the display if it is the same terminal as output
+	isTerminal bool
+	captureLog bool
+	mutex      sync.Mutex
+	linesDrawn int
+	lastLines  []string
+	samples    []int64 //bytes transferred at each tick, for working out the speed
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+func NewProgressDisplay(tracker *downloadmanager.ProgressTracker, output *os.File) *ProgressDisplay {
+	return &ProgressDisplay{
+		tracker:    tracker,
+		output:     output,
+		logOutput:  os.Stderr,
+		isTerminal: isTerminal(output),
+		samples:    make([]int64, 0, speedWindow+1),
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+}
+
+/**
+starts updating the display in the background. If the log is going to the same terminal, it is redirected through the
+display so that it doesn't get tangled up with the progress lines. If it has been redirected somewhere else, e.g. to a
+file, it is left alone.
+*/
+func (p *ProgressDisplay) Start() {
+	p.captureLog = p.isTerminal && sameTerminal(p.output, p.logOutput)
+	if p.captureLog {
+		log.SetOutput(p)
+	}
+	go p.run()
+}
+
+/**
+stops the display, leaving the final state on the screen
+*/
+func (p *ProgressDisplay) Stop() {
+	close(p.stopChan)
+	<-p.doneChan
+	if p.captureLog {
+		log.SetOutput(p.logOutput)
+	}
+}
+
+func (p *ProgressDisplay) run() {
+	defer close(p.doneChan)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	ticks := 0
+	for {
+		select {
+		case <-p.stopChan:
+			p.update(true)
+			return
+		case <-ticker.C:
+			ticks += 1
+			//when we are just writing to a log file, don't flood it
+			p.update(p.isTerminal || ticks%30 == 0)
+		}
+	}
+}
+
+func (p *ProgressDisplay) update(shouldRender bool) {
+	snapshot := p.tracker.Snapshot()
+
+	p.samples = append(p.samples, snapshot.BytesTransferred)
+	if len(p.samples) > speedWindow+1 {
+		p.samples = p.samples[1:]
+	}
+	var bytesPerSecond int64 = 0
+	if len(p.samples) > 1 {
+		bytesPerSecond = (p.samples[len(p.samples)-1] - p.samples[0]) / int64(len(p.samples)-1)
+	}
+
+	if !shouldRender {
+		return
+	}
+	lines := renderProgress(snapshot, bytesPerSecond)
+	if p.isTerminal {
+		p.mutex.Lock()
+		p.clear()
+		p.draw(lines)
+		p.mutex.Unlock()
+	} else {
+		log.Printf("INFO progress %s", lines[0])
+	}
+}
+
+/**
+formats the snapshot as a list of lines. The first line is the overall progress, followed by one per download thread
+*/
+func renderProgress(snapshot downloadmanager.ProgressSnapshot, bytesPerSecond int64) []string {
+	eta := "unknown"
+	remaining := snapshot.BytesTotal - snapshot.BytesDone
+	if bytesPerSecond > 0 && remaining >= 0 {
+		eta = (time.Duration(remaining/bytesPerSecond) * time.Second).String()
+	}
+
+	lines := []string{
+		fmt.Sprintf("%s / %s, %d / %d files, %s/s, ETA %s",
+			FormatByteSize(snapshot.BytesDone, 0),
+			FormatByteSize(snapshot.BytesTotal, 0),
+			snapshot.FilesDone,
+			snapshot.FilesTotal,
+			FormatByteSize(bytesPerSecond, 0),
+			eta),
+	}
+	for i, worker := range snapshot.Workers {
+		if worker.Active {
+			lines = append(lines, fmt.Sprintf("  [%d] %s / %s %s",
+				i+1,
+				FormatByteSize(worker.BytesDone, 0),
+				FormatByteSize(worker.BytesTotal, 0),
+				worker.Path))
+		} else {
+			lines = append(lines, fmt.Sprintf("  [%d] idle", i+1))
+		}
+	}
+	return lines
+}
+
+//must be called with the mutex held
+func (p *ProgressDisplay) clear() {
+	if p.linesDrawn > 0 {
+		fmt.Fprintf(p.output, "\033[%dA\033[J", p.linesDrawn)
+		p.linesDrawn = 0
+	}
+}
+
+/**
+cuts the line down to fit in the given number of columns, so that it doesn't wrap and throw out the redraw
+*/
+func clipLine(line string, width int) string {
+	runes := []rune(line)
+	if width <= 0 || len(runes) <= width {
+		return line
+	} else if width <= 3 {
+		return string(runes[:width])
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+//must be called with the mutex held
+func (p *ProgressDisplay) draw(lines []string) {
+	//leave the last column free, some terminals wrap as soon as it is written to
+	width := terminalWidth(p.output) - 1
+	clipped := make([]string, len(lines))
+	for i, line := range lines {
+		clipped[i] = clipLine(line, width)
+	}
+	fmt.Fprint(p.output, strings.Join(clipped, "\n")+"\n")
+	p.linesDrawn = len(lines)
+	p.lastLines = lines
+}
+
+/**
+Write implements io.Writer, so that log output can be printed above the progress lines
+*/
+func (p *ProgressDisplay) Write(content []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.clear()
+	n, err := p.logOutput.Write(content)
+	if p.lastLines != nil {
+		p.draw(p.lastLines)
+	}
+	return n, err
+}
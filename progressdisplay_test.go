@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestClipLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		width    int
+		expected string
+	}{
+		{"  [1] 1 MiB / 5 MiB card1/clip.mov", 80, "  [1] 1 MiB / 5 MiB card1/clip.mov"},
+		{"  [1] 1 MiB / 5 MiB card1/clip.mov", 20, "  [1] 1 MiB / 5 M..."},
+		{"  [1] 1 MiB / 5 MiB card1/clip.mov", 0, "  [1] 1 MiB / 5 MiB card1/clip.mov"},
+		{"ééééé", 4, "é..."},
+		{"abcdef", 2, "ab"},
+	}
+	for _, test := range tests {
+		if result := clipLine(test.line, test.width); result != test.expected {
+			t.Errorf("clipLine(%q, %d): expected %q got %q", test.line, test.width, test.expected, result)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/**
+asks for SIGHUP to be delivered to the given channel, to reload settings
+*/
+func notifyReload(ch chan os.Signal) {
+	signal.Notify(ch, syscall.SIGHUP)
+}
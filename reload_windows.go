@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+/**
+there is no SIGHUP on Windows, settings are reloaded when the config file changes
+*/
+func notifyReload(ch chan os.Signal) {
+}
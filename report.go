@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/guardian/autopull/communicator"
+	"github.com/guardian/autopull/downloadmanager"
+	"io/ioutil"
+	"time"
+)
+
+type ReportEntry struct {
+	EntryId         string  `json:"entryId"`
+	Path            string  `json:"path"`
+	LocalPath       string  `json:"localPath,omitempty"`
+	Renamed         bool    `json:"renamed,omitempty"`         //true if the name had to be changed to be valid on the local filesystem
+	ConflictRenamed bool    `json:"conflictRenamed,omitempty"` //true if the name had to be changed because a file already existed with it
+	Size            int64   `json:"size"`
+	Status          string  `json:"status"`
+	Checksum        string  `json:"checksum,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	BytesDownloaded int64   `json:"bytesDownloaded"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+/**
+machine-readable record of a download run, written out with the --report option
+*/
+type RunReport struct {
+	Lightbox       communicator.LightboxEntry `json:"lightbox"`
+	RetrievalToken string                     `json:"retrievalToken"`
+	StartTime      time.Time                  `json:"startTime"`
+	EndTime        time.Time                  `json:"endTime"`
+	Entries        []ReportEntry              `json:"entries"`
+}
+
+func NewRunReport(downloadInfo *communicator.BulkDownloadInitiateResponse, startTime time.Time, endTime time.Time, results []*downloadmanager.DownloadResult) *RunReport {
+	entries := make([]ReportEntry, len(results))
+	for i, result := range results {
+		entries[i] = ReportEntry{
+			EntryId:         result.Entry.EntryId,
+			Path:            result.Entry.Path,
+			LocalPath:       result.LocalPath,
+			Renamed:         result.Renamed,
+			ConflictRenamed: result.ConflictRenamed,
+			Size:            result.Entry.FileSize,
+			Status:          result.Status.String(),
+			Checksum:        result.Checksum,
+			BytesDownloaded: result.Bytes,
+			DurationSeconds: result.Duration.Seconds(),
+		}
+		if result.Error != nil {
+			entries[i].Error = result.Error.Error()
+		}
+	}
+
+	return &RunReport{
+		Lightbox:       downloadInfo.Metadata,
+		RetrievalToken: downloadInfo.RetrievalToken,
+		StartTime:      startTime,
+		EndTime:        endTime,
+		Entries:        entries,
+	}
+}
+
+func (r *RunReport) WriteToFile(path string) error {
+	content, marshalErr := json.MarshalIndent(r, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,236 @@
+package state
+
+import (
+	"encoding/json"
+	"github.com/guardian/autopull/communicator"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//name of the state file, kept in the top level of the download folder
+const StateFileName = ".autopull-state.json"
+
+type EntryState struct {
+	EntryId     string     `json:"entryId"`
+	Path        string     `json:"path"`
+	Size        int64      `json:"size"`
+	LocalPath   string     `json:"localPath,omitempty"`
+	Checksum    string     `json:"checksum,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"` //nil until the entry has been downloaded
+}
+
+/**
+everything we know about one retrieval token, i.e. one lightbox bulk download
+*/
+type RunState struct {
+	RetrievalToken string                     `json:"retrievalToken"`
+	Lightbox       communicator.LightboxEntry `json:"lightbox"`
+	FirstRun       time.Time                  `json:"firstRun"`
+	LastRun        time.Time                  `json:"lastRun"`
+	Entries        map[string]*EntryState     `json:"entries"` //keyed by entry id
+}
+
+/**
+returns the entries that have not been downloaded yet, sorted by path
+*/
+func (r *RunState) Outstanding() []*EntryState {
+	rtn := make([]*EntryState, 0)
+	for _, entry := range r.Entries {
+		if entry.CompletedAt == nil {
+			rtn = append(rtn, entry)
+		}
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Path < rtn[j].Path })
+	return rtn
+}
+
+type stateFile struct {
+	Runs map[string]*RunState `json:"runs"` //keyed by retrieval token
+}
+
+/**
+records what has been downloaded from each retrieval token so that running the same link again only fetches what is
+missing. Safe to use from multiple goroutines.
+*/
+type Store struct {
+	path    string
+	mutex   sync.Mutex
+	content stateFile
+}
+
+/**
+loads the state file from the given download folder, or starts an empty one if there is not one there yet
+*/
+func Open(downloadPath string) (*Store, error) {
+	s := &Store{
+		path:    filepath.Join(downloadPath, StateFileName),
+		content: stateFile{Runs: make(map[string]*RunState)},
+	}
+
+	rawContent, readErr := ioutil.ReadFile(s.path)
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			return s, nil
+		}
+		return nil, readErr
+	}
+	if unmarshalErr := json.Unmarshal(rawContent, &s.content); unmarshalErr != nil {
+		log.Printf("ERROR state.Open %s is not valid: %s", s.path, unmarshalErr)
+		return nil, unmarshalErr
+	}
+	if s.content.Runs == nil {
+		s.content.Runs = make(map[string]*RunState)
+	}
+	return s, nil
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+/**
+records the lightbox and list of entries for a run, keeping anything we already know about entries from previous runs
+*/
+func (s *Store) RecordManifest(downloadInfo *communicator.BulkDownloadInitiateResponse) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	run, haveRun := s.content.Runs[downloadInfo.RetrievalToken]
+	if !haveRun {
+		run = &RunState{
+			RetrievalToken: downloadInfo.RetrievalToken,
+			FirstRun:       now,
+			Entries:        make(map[string]*EntryState),
+		}
+		s.content.Runs[downloadInfo.RetrievalToken] = run
+	}
+	run.Lightbox = downloadInfo.Metadata
+	run.LastRun = now
+
+	for _, ent := range downloadInfo.Entries {
+		existing, haveEntry := run.Entries[ent.EntryId]
+		if haveEntry && existing.Size == ent.FileSize {
+			existing.Path = ent.Path
+			continue
+		}
+		//either new or changed on the server, so it needs downloading
+		run.Entries[ent.EntryId] = &EntryState{
+			EntryId: ent.EntryId,
+			Path:    ent.Path,
+			Size:    ent.FileSize,
+		}
+	}
+	return s.save()
+}
+
+/**
+records that an entry has been downloaded in full
+*/
+func (s *Store) MarkCompleted(retrievalToken string, entry *communicator.ArchiveEntryDownloadSynopsis, localPath string, checksum string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	run, haveRun := s.content.Runs[retrievalToken]
+	if !haveRun {
+		run = &RunState{
+			RetrievalToken: retrievalToken,
+			FirstRun:       time.Now(),
+			LastRun:        time.Now(),
+			Entries:        make(map[string]*EntryState),
+		}
+		s.content.Runs[retrievalToken] = run
+	}
+
+	completedAt := time.Now()
+	run.Entries[entry.EntryId] = &EntryState{
+		EntryId:     entry.EntryId,
+		Path:        entry.Path,
+		Size:        entry.FileSize,
+		LocalPath:   localPath,
+		Checksum:    checksum,
+		CompletedAt: &completedAt,
+	}
+	return s.save()
+}
+
+/**
+returns the recorded state of the given entry if it was downloaded by a previous run and the file is still there with
+the right size, or nil if it needs downloading
+*/
+func (s *Store) CompletedEntry(retrievalToken string, entry *communicator.ArchiveEntryDownloadSynopsis) *EntryState {
+	s.mutex.Lock()
+	run, haveRun := s.content.Runs[retrievalToken]
+	var recorded *EntryState
+	if haveRun {
+		recorded = run.Entries[entry.EntryId]
+	}
+	s.mutex.Unlock()
+
+	if recorded == nil || recorded.CompletedAt == nil || recorded.Size != entry.FileSize || recorded.LocalPath == "" {
+		return nil
+	}
+	info, statErr := os.Stat(recorded.LocalPath)
+	if statErr != nil || info.Size() != recorded.Size {
+		return nil
+	}
+	return recorded
+}
+
+/**
+returns every run that we know about, most recent first
+*/
+func (s *Store) Runs() []*RunState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rtn := make([]*RunState, 0, len(s.content.Runs))
+	for _, run := range s.content.Runs {
+		rtn = append(rtn, run)
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].LastRun.After(rtn[j].LastRun) })
+	return rtn
+}
+
+/**
+writes the state out to a temporary file and moves it into place, so that an interrupted write can't leave a broken
+state file behind. Must be called with the mutex held.
+*/
+func (s *Store) save() error {
+	content, marshalErr := json.MarshalIndent(&s.content, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	if dirErr := os.MkdirAll(filepath.Dir(s.path), 0755); dirErr != nil {
+		return dirErr
+	}
+	tempFile, tempErr := ioutil.TempFile(filepath.Dir(s.path), StateFileName+".*")
+	if tempErr != nil {
+		return tempErr
+	}
+	tempName := tempFile.Name()
+	tempFile.Chmod(0644)
+	_, writeErr := tempFile.Write(content)
+	if writeErr == nil {
+		writeErr = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(tempName)
+		return writeErr
+	}
+	if renameErr := os.Rename(tempName, s.path); renameErr != nil {
+		os.Remove(tempName)
+		return renameErr
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"github.com/guardian/autopull/communicator"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "autopull-test")
+	defer os.RemoveAll(tempDir)
+
+	store, openErr := Open(tempDir)
+	if openErr != nil {
+		t.Fatalf("could not open empty state: %s", openErr)
+	}
+
+	entries := []communicator.ArchiveEntryDownloadSynopsis{
+		{EntryId: "e1", Path: "a.mov", FileSize: 5},
+		{EntryId: "e2", Path: "b.mov", FileSize: 7},
+	}
+	info := &communicator.BulkDownloadInitiateResponse{
+		Metadata:       communicator.LightboxEntry{Description: "my lightbox"},
+		RetrievalToken: "tok",
+		Entries:        entries,
+	}
+	if err := store.RecordManifest(info); err != nil {
+		t.Fatalf("could not record manifest: %s", err)
+	}
+
+	localPath := filepath.Join(tempDir, "a.mov")
+	ioutil.WriteFile(localPath, []byte("12345"), 0644)
+	if err := store.MarkCompleted("tok", &entries[0], localPath, "md5:abcd"); err != nil {
+		t.Fatalf("could not mark entry completed: %s", err)
+	}
+
+	reloaded, reloadErr := Open(tempDir)
+	if reloadErr != nil {
+		t.Fatalf("could not reload state: %s", reloadErr)
+	}
+	if completed := reloaded.CompletedEntry("tok", &entries[0]); completed == nil || completed.Checksum != "md5:abcd" {
+		t.Errorf("e1 should have been recorded as completed, got %v", completed)
+	}
+	if completed := reloaded.CompletedEntry("tok", &entries[1]); completed != nil {
+		t.Errorf("e2 should not have been recorded as completed")
+	}
+	if completed := reloaded.CompletedEntry("othertoken", &entries[0]); completed != nil {
+		t.Errorf("e1 should not be completed for a different token")
+	}
+
+	runs := reloaded.Runs()
+	if len(runs) != 1 || runs[0].Lightbox.Description != "my lightbox" {
+		t.Fatalf("expected the one run to be reloaded, got %v", runs)
+	}
+	outstanding := runs[0].Outstanding()
+	if len(outstanding) != 1 || outstanding[0].EntryId != "e2" {
+		t.Errorf("expected e2 to be outstanding, got %v", outstanding)
+	}
+
+	//a file that has changed size since it was downloaded must be fetched again
+	ioutil.WriteFile(localPath, []byte("123"), 0644)
+	if completed := reloaded.CompletedEntry("tok", &entries[0]); completed != nil {
+		t.Errorf("e1 should need downloading again when the local file is the wrong size")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"github.com/guardian/autopull/state"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+writes out what is still outstanding for each lightbox that has been downloaded into this folder
+*/
+func printStatus(output io.Writer, store *state.Store) {
+	runs := store.Runs()
+	if len(runs) == 0 {
+		fmt.Fprintf(output, "Nothing has been downloaded to this folder yet.\n")
+		return
+	}
+
+	for _, run := range runs {
+		outstanding := run.Outstanding()
+		var outstandingBytes int64 = 0
+		for _, entry := range outstanding {
+			outstandingBytes += entry.Size
+		}
+
+		description := run.Lightbox.Description
+		if description == "" {
+			description = run.RetrievalToken
+		}
+		fmt.Fprintf(output, "%s (%s), last run %s\n", description, run.Lightbox.UserEmail, run.LastRun.Format(time.RFC1123))
+		fmt.Fprintf(output, "  %d of %d files downloaded, %d outstanding totalling %s\n",
+			len(run.Entries)-len(outstanding),
+			len(run.Entries),
+			len(outstanding),
+			FormatByteSize(outstandingBytes, 0))
+
+		if len(outstanding) > 0 {
+			writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+			for _, entry := range outstanding {
+				fmt.Fprintf(writer, "    %s\t%s\n", entry.Path, FormatByteSize(entry.Size, 0))
+			}
+			writer.Flush()
+		}
+		fmt.Fprintln(output)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/guardian/autopull/communicator"
+	"github.com/guardian/autopull/downloadmanager"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+//exit codes for a run that got as far as downloading. Codes below these are used for setup errors in main()
+const (
+	ExitPartialFailure = 8  //some files were not downloaded
+	ExitTotalFailure   = 9  //no files were downloaded
+	ExitInterrupted    = 10 //the run was stopped before everything was done
+	ExitFileConflict   = 12 //the run was stopped because a file already existed and conflict_policy is fail-run
+	ExitDiskFull       = 13 //the run was stopped because the download folder ran out of space
+)
+
+/**
+works out the exit code to use for the given set of results
+*/
+func exitCodeForResults(results []*downloadmanager.DownloadResult) int {
+	successCount := 0
+	cancelledCount := 0
+	filteredCount := 0
+	conflicted := false
+	diskFull := false
+	for _, result := range results {
+		if result.Error == downloadmanager.FileConflict {
+			conflicted = true
+		} else if result.Error == downloadmanager.DiskFull {
+			diskFull = true
+		}
+		if result.Status == downloadmanager.StatusFiltered {
+			filteredCount += 1
+		} else if result.Status.IsSuccess() {
+			successCount += 1
+		} else if result.Status == downloadmanager.StatusCancelled {
+			cancelledCount += 1
+		}
+	}
+
+	//the run stopping itself leaves the remaining entries cancelled, that is not the same as the user interrupting it
+	if diskFull {
+		return ExitDiskFull
+	} else if conflicted {
+		return ExitFileConflict
+	} else if cancelledCount > 0 {
+		return ExitInterrupted
+	} else if successCount == len(results)-filteredCount {
+		return 0
+	} else if successCount == 0 {
+		return ExitTotalFailure
+	} else {
+		return ExitPartialFailure
+	}
+}
+
+/**
+writes out a table of the outcome for every entry, followed by the totals for each status
+*/
+func printSummary(output io.Writer, results []*downloadmanager.DownloadResult) {
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PATH\tSTATUS\tSIZE\tTIME\tREASON")
+
+	counts := make(map[downloadmanager.ResultStatus]int)
+	var totalBytes int64 = 0
+	diskFull := false
+	tokenInvalid := false
+	for _, result := range results {
+		counts[result.Status] += 1
+		if result.Error == downloadmanager.DiskFull {
+			diskFull = true
+		} else if errors.Is(result.Error, communicator.ErrTokenInvalid) {
+			tokenInvalid = true
+		}
+		totalBytes += result.Bytes
+
+		reason := ""
+		if result.Error != nil {
+			reason = result.Error.Error()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+			result.Entry.Path,
+			result.Status,
+			FormatByteSize(result.Entry.FileSize, 0),
+			result.Duration.Round(time.Second),
+			reason)
+	}
+	writer.Flush()
+
+	fmt.Fprintf(output, "\nDownloaded %d, already present %d, not restored %d, failed %d. %s downloaded in total.\n",
+		counts[downloadmanager.StatusDownloaded],
+		counts[downloadmanager.StatusSkippedExists],
+		counts[downloadmanager.StatusNotRestored],
+		counts[downloadmanager.StatusFailed],
+		FormatByteSize(totalBytes, 0))
+	if counts[downloadmanager.StatusUnsafePath] > 0 {
+		fmt.Fprintf(output, "SECURITY WARNING: %d files were rejected because their paths would have been written outside the download folder.\n", counts[downloadmanager.StatusUnsafePath])
+	}
+	if counts[downloadmanager.StatusFiltered] > 0 {
+		fmt.Fprintf(output, "%d files were left out by the include, exclude and size filters.\n", counts[downloadmanager.StatusFiltered])
+	}
+	if diskFull {
+		fmt.Fprintf(output, "The download folder ran out of space. Free some up and run the same link again to carry on.\n")
+	}
+	if tokenInvalid {
+		fmt.Fprintf(output, "%s\n", serverErrorAdvice(communicator.ErrTokenInvalid))
+	}
+	if counts[downloadmanager.StatusCancelled] > 0 {
+		fmt.Fprintf(output, "%d files were not finished because the run was interrupted.\n", counts[downloadmanager.StatusCancelled])
+	}
+}
+
+/**
+returns a suggestion for the user about what to do after an error from the server
+*/
+func serverErrorAdvice(err error) string {
+	switch {
+	case errors.Is(err, communicator.ErrTokenInvalid):
+		return "The server did not accept the download link, it has probably expired. Start the download again from your browser."
+	case errors.Is(err, communicator.ErrRateLimited):
+		return "The server is too busy right now. Wait a while and run the same link again."
+	case errors.Is(err, communicator.ErrServerUnavailable):
+		return "The server is not available right now. Wait a while and run the same link again."
+	case errors.Is(err, communicator.ErrMalformedResponse):
+		return "The server sent something that could not be understood. Check that vaultdoor_uri and archivehunter_uri in the settings file are correct."
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/guardian/autopull/downloadmanager"
+	"testing"
+)
+
+func TestExitCodeForResults(t *testing.T) {
+	allGood := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusDownloaded},
+		{Status: downloadmanager.StatusSkippedExists},
+	}
+	if code := exitCodeForResults(allGood); code != 0 {
+		t.Errorf("exitCodeForResults should have returned 0 for a successful run but got %d", code)
+	}
+
+	someBad := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusDownloaded},
+		{Status: downloadmanager.StatusNotRestored},
+	}
+	if code := exitCodeForResults(someBad); code != ExitPartialFailure {
+		t.Errorf("exitCodeForResults should have returned %d for a partial failure but got %d", ExitPartialFailure, code)
+	}
+
+	allBad := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusFailed},
+		{Status: downloadmanager.StatusNotRestored},
+	}
+	if code := exitCodeForResults(allBad); code != ExitTotalFailure {
+		t.Errorf("exitCodeForResults should have returned %d for a total failure but got %d", ExitTotalFailure, code)
+	}
+
+	if code := exitCodeForResults([]*downloadmanager.DownloadResult{}); code != 0 {
+		t.Errorf("exitCodeForResults should have returned 0 when there was nothing to do but got %d", code)
+	}
+
+	someFiltered := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusDownloaded},
+		{Status: downloadmanager.StatusFiltered},
+	}
+	if code := exitCodeForResults(someFiltered); code != 0 {
+		t.Errorf("exitCodeForResults should not count filtered entries as failures but got %d", code)
+	}
+
+	interrupted := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusDownloaded},
+		{Status: downloadmanager.StatusCancelled},
+	}
+	if code := exitCodeForResults(interrupted); code != ExitInterrupted {
+		t.Errorf("exitCodeForResults should have returned %d for an interrupted run but got %d", ExitInterrupted, code)
+	}
+
+	conflicted := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusDownloaded},
+		{Status: downloadmanager.StatusFailed, Error: downloadmanager.FileConflict},
+		{Status: downloadmanager.StatusCancelled, Error: downloadmanager.RunStopped},
+	}
+	if code := exitCodeForResults(conflicted); code != ExitFileConflict {
+		t.Errorf("exitCodeForResults should have returned %d for a run stopped by a conflict but got %d", ExitFileConflict, code)
+	}
+
+	diskFull := []*downloadmanager.DownloadResult{
+		{Status: downloadmanager.StatusDownloaded},
+		{Status: downloadmanager.StatusFailed, Error: downloadmanager.DiskFull},
+		{Status: downloadmanager.StatusCancelled, Error: downloadmanager.RunStopped},
+	}
+	if code := exitCodeForResults(diskFull); code != ExitDiskFull {
+		t.Errorf("exitCodeForResults should have returned %d for a run stopped by a full disk but got %d", ExitDiskFull, code)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/**
+returns true if the given file is an interactive terminal that we can draw progress on
+*/
+func isTerminal(f *os.File) bool {
+	info, statErr := f.Stat()
+	if statErr != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+/**
+returns true if the two files are the same terminal, e.g. stdout and stderr when neither has been redirected
+*/
+func sameTerminal(a *os.File, b *os.File) bool {
+	if !isTerminal(a) || !isTerminal(b) {
+		return false
+	}
+	aInfo, aErr := a.Stat()
+	bInfo, bErr := b.Stat()
+	return aErr == nil && bErr == nil && os.SameFile(aInfo, bInfo)
+}
+
+type winsize struct {
+	rows    uint16
+	columns uint16
+	xPixels uint16
+	yPixels uint16
+}
+
+/**
+returns how many columns wide the terminal is, or a guess if we can't tell
+*/
+func terminalWidth(f *os.File) int {
+	var size winsize
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&size)))
+	if errno != 0 || size.columns == 0 {
+		return defaultTerminalWidth()
+	}
+	return int(size.columns)
+}
@@ -0,0 +1,73 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const enableVirtualTerminalProcessing = 0x0004
+
+var (
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	procGetConsoleMode = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+/**
+returns true if the given file is a console that we can draw progress on. This needs the console to understand
+ANSI escape codes, so we try to switch that on; older versions of Windows don't support it and get log lines instead.
+*/
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	result, _, _ := procGetConsoleMode.Call(f.Fd(), uintptr(unsafe.Pointer(&mode)))
+	if result == 0 {
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	result, _, _ = procSetConsoleMode.Call(f.Fd(), uintptr(mode|enableVirtualTerminalProcessing))
+	return result != 0
+}
+
+/**
+returns true if the two files are the same console. A process only has one console, so if they both are then they are
+the same one.
+*/
+func sameTerminal(a *os.File, b *os.File) bool {
+	return isTerminal(a) && isTerminal(b)
+}
+
+type coord struct {
+	x int16
+	y int16
+}
+
+type consoleScreenBufferInfo struct {
+	size              coord
+	cursorPosition    coord
+	attributes        uint16
+	windowLeft        int16
+	windowTop         int16
+	windowRight       int16
+	windowBottom      int16
+	maximumWindowSize coord
+}
+
+/**
+returns how many columns wide the console window is, or a guess if we can't tell
+*/
+func terminalWidth(f *os.File) int {
+	var info consoleScreenBufferInfo
+	result, _, _ := procGetConsoleScreenBufferInfo.Call(f.Fd(), uintptr(unsafe.Pointer(&info)))
+	if result == 0 || info.windowRight <= info.windowLeft {
+		return defaultTerminalWidth()
+	}
+	return int(info.windowRight-info.windowLeft) + 1
+}